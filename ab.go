@@ -0,0 +1,25 @@
+package main
+
+import (
+	"math/rand/v2"
+	"net/http"
+)
+
+const variantCookie = "fastserve_variant"
+
+// inVariantB reports whether the visitor is routed to variant B, assigning
+// new visitors to it with probability s.variantPercent and remembering the
+// choice in a cookie.
+func (s *server) inVariantB(w http.ResponseWriter, r *http.Request) bool {
+	varyOn(w.Header(), "Cookie")
+	if c, err := r.Cookie(variantCookie); err == nil && (c.Value == "a" || c.Value == "b") {
+		return c.Value == "b"
+	}
+	b := rand.Float64()*100 < s.variantPercent
+	value := "a"
+	if b {
+		value = "b"
+	}
+	http.SetCookie(w, &http.Cookie{Name: variantCookie, Value: value, Path: "/", MaxAge: 30 * 24 * 60 * 60, SameSite: http.SameSiteLaxMode})
+	return b
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"net/http"
+)
+
+// fileAccess decides which cached files a listing, such as /_/search or an
+// archive download, may include for the request it answers: those the
+// request would be served by the -auth rules, -login-path and the auth of
+// their metadata, from the country it comes from under -geo rules. Paths
+// checked with -forward-auth are left out, as its endpoint decides per
+// request. Credentials are verified once, up front,
+// so that checking paths with s.mu held never waits on a JWKS fetch.
+type fileAccess struct {
+	s *server
+	r *http.Request
+	// all is set for trusted callers, such as the admin endpoints.
+	all       bool
+	basicUser bool
+	claims    map[string]any
+	// geo is set for a request checked against the -geo rules, from
+	// country.
+	geo     bool
+	country string
+}
+
+type adminRequestKey struct{}
+
+// trustRequests marks the requests h handles as coming from the admin
+// listener, whose listings include every file.
+func trustRequests(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), adminRequestKey{}, true)))
+	})
+}
+
+// requestAccess returns the access of r, verifying the basic credentials
+// and bearer token it carries.
+func (s *server) requestAccess(r *http.Request) *fileAccess {
+	if r.Context().Value(adminRequestKey{}) != nil {
+		return s.fullAccess()
+	}
+	a := &fileAccess{s: s, r: r}
+	if s.geoDB != nil && len(s.geoRules) > 0 {
+		a.geo, a.country = true, s.clientCountry(r)
+	}
+	if _, _, ok := r.BasicAuth(); ok && s.basicUsers != nil {
+		_, a.basicUser = s.basicUser(r)
+	}
+	if s.jwtKeys != nil && s.jwtKeys.url != "" {
+		if claims, err := s.bearerClaims(r); err == nil {
+			a.claims = claims
+		}
+	}
+	return a
+}
+
+// publicAccess is the access of an anonymous client, for what's sent to
+// third parties, such as webhooks.
+func (s *server) publicAccess() *fileAccess {
+	return &fileAccess{s: s}
+}
+
+// fullAccess includes every file, for the admin endpoints and fastserve
+// check.
+func (s *server) fullAccess() *fileAccess {
+	return &fileAccess{s: s, all: true}
+}
+
+// allows reports whether the file at path may be listed. entry is nil for
+// a file no longer cached, which is judged by its path alone. It must be
+// called with s.mu held.
+func (a *fileAccess) allows(path string, entry *fileCache) bool {
+	if a.all {
+		return true
+	}
+	s := a.s
+	if base, baseEntry, ok := s.siblingBase(path); ok {
+		path, entry = base, baseEntry
+	}
+	if a.geo && !s.geoAllows(path, a.country) {
+		return false
+	}
+	if rule, ok := s.authRule(path); ok && !a.passes(rule) {
+		return false
+	}
+	if s.oidc != nil && matchAny(s.loginPaths, path) && !a.passes(authRule{mechanism: "login"}) {
+		return false
+	}
+	if s.forwardAuthURL != "" && (len(s.forwardAuthPaths) == 0 || matchAny(s.forwardAuthPaths, path)) {
+		return false
+	}
+	if entry != nil {
+		if m := s.meta(path, entry); m.auth != nil && m.auth.mechanism != "public" && !a.passes(*m.auth) {
+			return false
+		}
+	}
+	return true
+}
+
+// passes reports whether the request satisfies rule, through its session
+// or the credentials it carries.
+func (a *fileAccess) passes(rule authRule) bool {
+	if a.r == nil {
+		return false
+	}
+	if _, ok := a.s.session(a.r, rule.scope()); ok {
+		return true
+	}
+	switch rule.mechanism {
+	case "basic":
+		return a.basicUser
+	case "jwt":
+		return a.claims != nil && (rule.claim == "" || hasClaim(a.claims, rule.claim, rule.value))
+	}
+	return false
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// loadArchive caches the entries of a zip or tar archive instead of a
+// directory, reloading them whenever the archive's modification time
+// changes.
+func (s *server) loadArchive(ignore regexp.Regexp) error {
+	info, err := os.Stat(s.archive)
+	if err != nil {
+		return err
+	}
+	if info.ModTime().Equal(s.archiveModTime) {
+		return nil
+	}
+
+	next := make(map[string]*fileCache)
+	if err := readArchive(s.archive, func(name string, info fs.FileInfo, r io.Reader) error {
+		relPath := norm.NFC.String(path.Clean(strings.TrimPrefix(name, "/")))
+		if relPath == ".." || strings.HasPrefix(relPath, "../") {
+			return nil
+		}
+		return s.visit(next, relPath, info, "", ignore, func() ([]byte, error) {
+			return io.ReadAll(r)
+		})
+	}); err != nil {
+		return err
+	}
+
+	s.archiveModTime = info.ModTime()
+	s.swap(next, 0)
+	return nil
+}
+
+// readArchive calls fn for every entry of a zip, tar, tar.gz or tgz file.
+func readArchive(name string, fn func(name string, info fs.FileInfo, r io.Reader) error) error {
+	if strings.HasSuffix(strings.ToLower(name), ".zip") {
+		zr, err := zip.OpenReader(name)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		for _, f := range zr.File {
+			rc, err := f.Open()
+			if err != nil {
+				return err
+			}
+			err = fn(f.Name, f.FileInfo(), rc)
+			rc.Close()
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	file, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var r io.Reader = file
+	if lower := strings.ToLower(name); strings.HasSuffix(lower, ".gz") || strings.HasSuffix(lower, ".tgz") {
+		gr, err := gzip.NewReader(file)
+		if err != nil {
+			return err
+		}
+		defer gr.Close()
+		r = gr
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := fn(hdr.Name, hdr.FileInfo(), tr); err != nil {
+			return err
+		}
+	}
+}
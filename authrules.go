@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bufio"
+	"crypto"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// authRule requires one authentication mechanism for matching paths:
+// public for none, basic for a user in -basic-auth-file, login for an OIDC
+// session, or jwt for a bearer token from -jwt-jwks, optionally with a claim
+// such as jwt:role=admin.
+type authRule struct {
+	pattern   *regexp.Regexp
+	mechanism string
+	claim     string
+	value     string
+}
+
+// parseAuthRules parses pattern=mechanism rules, such as
+// admin/**=jwt:role=admin, in the order they should be tried.
+func parseAuthRules(rules []string) ([]authRule, error) {
+	var parsed []authRule
+	for _, rule := range rules {
+		pattern, mechanism, _ := strings.Cut(rule, "=")
+		r, err := parseAuthMechanism(mechanism)
+		if err != nil {
+			return nil, fmt.Errorf("invalid auth rule %q", rule)
+		}
+		if r.pattern, err = compileGlob(pattern); err != nil {
+			return nil, err
+		}
+		parsed = append(parsed, r)
+	}
+	return parsed, nil
+}
+
+// parseAuthMechanism parses the mechanism of a rule, such as jwt:role=admin,
+// leaving its pattern unset.
+func parseAuthMechanism(mechanism string) (authRule, error) {
+	mechanism, requirement, _ := strings.Cut(mechanism, ":")
+	r := authRule{mechanism: mechanism}
+	switch mechanism {
+	case "public", "basic", "login":
+		if requirement != "" {
+			return r, fmt.Errorf("invalid auth mechanism %q", mechanism)
+		}
+	case "jwt":
+		if requirement != "" {
+			var ok bool
+			if r.claim, r.value, ok = strings.Cut(requirement, "="); !ok {
+				return r, fmt.Errorf("invalid auth requirement %q", requirement)
+			}
+		}
+	default:
+		return r, fmt.Errorf("invalid auth mechanism %q", mechanism)
+	}
+	return r, nil
+}
+
+// checkMechanism returns an error if the mechanism of rule lacks the flags
+// it's verified with, such as -oidc-issuer for login.
+func (s *server) checkMechanism(rule authRule) error {
+	switch {
+	case rule.mechanism == "basic" && s.basicUsers == nil:
+		return errors.New("basic authentication requires -basic-auth-file")
+	case rule.mechanism == "login" && s.oidc == nil:
+		return errors.New("login authentication requires -oidc-issuer")
+	case rule.mechanism == "jwt" && (s.jwtKeys == nil || s.jwtKeys.url == ""):
+		return errors.New("jwt authentication requires -jwt-jwks")
+	}
+	return nil
+}
+
+// loadBasicUsers reads user:hash lines with bcrypt hashes, as written by
+// htpasswd -B.
+func loadBasicUsers(name string) (map[string][]byte, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	users := make(map[string][]byte)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		user, hash, ok := strings.Cut(line, ":")
+		if !ok {
+			return nil, fmt.Errorf("%s: invalid line %q", name, line)
+		}
+		users[user] = []byte(hash)
+	}
+	return users, scanner.Err()
+}
+
+// authorize enforces the first auth rule matching each request's path.
+// Paths matching no rule are public.
+func (s *server) authorize(next http.HandlerFunc) http.HandlerFunc {
+	if len(s.authRules) == 0 {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if rule, ok := s.authRule(protectedPath(r.URL.Path)); ok {
+			w.Header().Set("Cache-Control", "private")
+			if !s.authenticate(w, r, rule) {
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	}
+}
+
+// authorizeFile enforces the auth rule and -login-path of path, the cached
+// file a request resolved to, where they aren't those authorize and
+// requireLogin enforced for the request path: index.html, NFC and the
+// language and A/B variants can each turn one into another. A compressed
+// copy, such as post.html.gz, is checked as its file. It reports whether
+// the request may go on.
+func (s *server) authorizeFile(w http.ResponseWriter, r *http.Request, path string) bool {
+	requested := protectedPath(r.URL.Path)
+	s.mu.RLock()
+	if base, _, ok := s.siblingBase(path); ok {
+		path = base
+	}
+	s.mu.RUnlock()
+	if rule, ok := s.authRule(path); ok {
+		if checked, ok := s.authRule(requested); !ok || checked != rule {
+			w.Header().Set("Cache-Control", "private")
+			if !s.authenticate(w, r, rule) {
+				return false
+			}
+		}
+	}
+	if s.oidc != nil && matchAny(s.loginPaths, path) && !matchAny(s.loginPaths, requested) {
+		w.Header().Set("Cache-Control", "private")
+		if _, ok := s.session(r, "login"); !ok {
+			s.startLogin(w, r)
+			return false
+		}
+	}
+	return true
+}
+
+// authRule returns the first auth rule matching a cached path, unless it's
+// public.
+func (s *server) authRule(path string) (authRule, bool) {
+	for _, rule := range s.authRules {
+		if rule.pattern.MatchString(path) {
+			return rule, rule.mechanism != "public"
+		}
+	}
+	return authRule{}, false
+}
+
+// scope is what a session issued for passing the rule is good for.
+func (rule authRule) scope() string {
+	if rule.claim != "" {
+		return rule.mechanism + ":" + rule.claim + "=" + rule.value
+	}
+	return rule.mechanism
+}
+
+// authenticate reports whether r satisfies rule, through its session or
+// otherwise, answering it if not.
+func (s *server) authenticate(w http.ResponseWriter, r *http.Request, rule authRule) bool {
+	if _, ok := s.session(r, rule.scope()); ok {
+		return true
+	}
+	switch rule.mechanism {
+	case "basic":
+		if user, ok := s.basicUser(r); ok {
+			s.setSession(w, r, rule.scope(), user)
+			return true
+		}
+		s.logViolation(r, "auth-failed")
+		w.Header().Set("WWW-Authenticate", `Basic realm="fastserve"`)
+		http.Error(w, "authentication required", http.StatusUnauthorized)
+
+	case "login":
+		s.startLogin(w, r)
+
+	case "jwt":
+		claims, err := s.bearerClaims(r)
+		if err == errNoBearer {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "authentication required", http.StatusUnauthorized)
+			return false
+		}
+		if err != nil {
+			s.logViolation(r, "auth-failed")
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return false
+		}
+		if rule.claim == "" || hasClaim(claims, rule.claim, rule.value) {
+			subject, _ := claims["sub"].(string)
+			s.setSession(w, r, rule.scope(), subject)
+			return true
+		}
+		s.logViolation(r, "auth-failed")
+		http.Error(w, "forbidden", http.StatusForbidden)
+	}
+	return false
+}
+
+// basicUser returns the user of r's basic authentication credentials, if
+// they're those of a user in -basic-auth-file.
+func (s *server) basicUser(r *http.Request) (string, bool) {
+	user, password, ok := r.BasicAuth()
+	if !ok || s.basicUsers[user] == nil || bcrypt.CompareHashAndPassword(s.basicUsers[user], []byte(password)) != nil {
+		return "", false
+	}
+	return user, true
+}
+
+var errNoBearer = errors.New("no bearer token")
+
+// bearerClaims returns the claims of r's bearer token, verified with
+// -jwt-jwks, -jwt-issuer and -jwt-audience.
+func (s *server) bearerClaims(r *http.Request) (map[string]any, error) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return nil, errNoBearer
+	}
+	claims, err := parseJWT(token, func(kid string) (crypto.PublicKey, error) {
+		return s.jwtKeys.key(r.Context(), kid)
+	})
+	switch {
+	case err != nil:
+	case s.jwtIssuer != "" && claims["iss"] != s.jwtIssuer:
+		err = fmt.Errorf("token not issued by %s", s.jwtIssuer)
+	case s.jwtAudience != "" && !audience(claims, s.jwtAudience):
+		err = fmt.Errorf("token not issued for %s", s.jwtAudience)
+	}
+	return claims, err
+}
+
+// hasClaim reports whether the claim is value, or a list including it.
+func hasClaim(claims map[string]any, claim, value string) bool {
+	switch v := claims[claim].(type) {
+	case string:
+		return v == value
+	case []any:
+		for _, item := range v {
+			if item == value {
+				return true
+			}
+		}
+	}
+	return false
+}
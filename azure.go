@@ -0,0 +1,175 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+const azureVersion = "2021-08-06"
+
+// azureClient talks to the Azure Blob Storage REST API, authenticating with
+// the AZURE_STORAGE_KEY account key or the AZURE_STORAGE_SAS_TOKEN SAS token
+// if either is set.
+type azureClient struct {
+	account   string
+	container string
+	prefix    string
+	key       []byte
+	sas       url.Values
+}
+
+// newAzureClient returns a client for an azure://account/container/prefix
+// URI.
+func newAzureClient(uri string) (*azureClient, error) {
+	account, path, err := splitBucketURI(uri, "azure")
+	if err != nil {
+		return nil, err
+	}
+	container, prefix, _ := strings.Cut(path, "/")
+	if container == "" {
+		return nil, fmt.Errorf("invalid azure URI %q: missing container", uri)
+	}
+	c := &azureClient{account: account, container: container, prefix: prefix}
+
+	if key := os.Getenv("AZURE_STORAGE_KEY"); key != "" {
+		if c.key, err = base64.StdEncoding.DecodeString(key); err != nil {
+			return nil, fmt.Errorf("AZURE_STORAGE_KEY: %w", err)
+		}
+	} else if sas := os.Getenv("AZURE_STORAGE_SAS_TOKEN"); sas != "" {
+		if c.sas, err = url.ParseQuery(strings.TrimPrefix(sas, "?")); err != nil {
+			return nil, fmt.Errorf("AZURE_STORAGE_SAS_TOKEN: %w", err)
+		}
+	}
+	return c, nil
+}
+
+type azureListResult struct {
+	Blobs []struct {
+		Name       string `xml:"Name"`
+		Properties struct {
+			LastModified  string `xml:"Last-Modified"`
+			ETag          string `xml:"Etag"`
+			ContentLength int64  `xml:"Content-Length"`
+		} `xml:"Properties"`
+	} `xml:"Blobs>Blob"`
+	NextMarker string `xml:"NextMarker"`
+}
+
+func (c *azureClient) list(fn func(object) error) error {
+	marker := ""
+	for {
+		query := url.Values{"restype": {"container"}, "comp": {"list"}, "prefix": {c.prefix}}
+		if marker != "" {
+			query.Set("marker", marker)
+		}
+		resp, err := c.do("", query)
+		if err != nil {
+			return err
+		}
+		var result azureListResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+		for _, blob := range result.Blobs {
+			modTime, _ := http.ParseTime(blob.Properties.LastModified)
+			err := fn(object{
+				key:     blob.Name,
+				path:    strings.TrimPrefix(blob.Name, c.prefix),
+				version: blob.Properties.ETag,
+				size:    blob.Properties.ContentLength,
+				modTime: modTime,
+			})
+			if err != nil {
+				return err
+			}
+		}
+		if result.NextMarker == "" {
+			return nil
+		}
+		marker = result.NextMarker
+	}
+}
+
+func (c *azureClient) get(key string) ([]byte, error) {
+	resp, err := c.do(key, url.Values{})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return io.ReadAll(resp.Body)
+}
+
+func (c *azureClient) do(blob string, query url.Values) (*http.Response, error) {
+	path := "/" + c.container
+	if blob != "" {
+		path += "/" + blob
+	}
+	signed := query
+	if c.sas != nil {
+		signed = url.Values{}
+		for k, v := range query {
+			signed[k] = v
+		}
+		for k, v := range c.sas {
+			signed[k] = v
+		}
+	}
+	u := url.URL{Scheme: "https", Host: c.account + ".blob.core.windows.net", Path: path, RawQuery: signed.Encode()}
+
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Ms-Date", time.Now().UTC().Format(http.TimeFormat))
+	req.Header.Set("X-Ms-Version", azureVersion)
+	if c.key != nil {
+		req.Header.Set("Authorization", "SharedKey "+c.account+":"+c.signature(req, req.URL.EscapedPath(), query))
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("azure GET %s: %s", path, resp.Status)
+	}
+	return resp, nil
+}
+
+// signature computes the Shared Key signature of a GET request without a
+// body.
+func (c *azureClient) signature(req *http.Request, path string, query url.Values) string {
+	var b strings.Builder
+	b.WriteString(req.Method + strings.Repeat("\n", 12))
+	b.WriteString("x-ms-date:" + req.Header.Get("X-Ms-Date") + "\n")
+	b.WriteString("x-ms-version:" + req.Header.Get("X-Ms-Version") + "\n")
+	b.WriteString("/" + c.account + path)
+
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		values := append([]string(nil), query[key]...)
+		sort.Strings(values)
+		b.WriteString("\n" + strings.ToLower(key) + ":" + strings.Join(values, ","))
+	}
+
+	h := hmac.New(sha256.New, c.key)
+	h.Write([]byte(b.String()))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
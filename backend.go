@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// A backend is a remote object store to serve files from, such as an S3
+// bucket.
+type backend interface {
+	// list calls fn for every object under the configured prefix.
+	list(fn func(object) error) error
+	// get returns the content of the object with the given key.
+	get(key string) ([]byte, error)
+}
+
+type object struct {
+	key     string
+	path    string
+	version string
+	// size is -1 where the listing doesn't give it.
+	size    int64
+	modTime time.Time
+}
+
+// remoteFile describes an object as a file.
+type remoteFile struct {
+	name    string
+	size    int64
+	modTime time.Time
+}
+
+func (f remoteFile) Name() string       { return f.name }
+func (f remoteFile) Size() int64        { return f.size }
+func (f remoteFile) Mode() fs.FileMode  { return 0o444 }
+func (f remoteFile) ModTime() time.Time { return f.modTime }
+func (f remoteFile) IsDir() bool        { return false }
+func (f remoteFile) Sys() any           { return nil }
+
+// loadBackend caches the objects of s.backend, refetching only those whose
+// version changed since the last load.
+func (s *server) loadBackend(ignore regexp.Regexp) error {
+	next := make(map[string]*fileCache)
+	skipped := 0
+	if err := s.backend.list(func(obj object) error {
+		if obj.path == "" || strings.HasSuffix(obj.path, "/") {
+			return nil
+		}
+		info := remoteFile{name: obj.path, size: obj.size, modTime: obj.modTime}
+		if err := s.visit(next, norm.NFC.String(obj.path), info, obj.version, ignore, func() ([]byte, error) {
+			return s.backend.get(obj.key)
+		}); err != nil {
+			s.skip(obj.path, err)
+			skipped++
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	s.swap(next, skipped)
+	return nil
+}
+
+// splitBucketURI splits a scheme://bucket/prefix URI, returning the prefix
+// with a trailing slash unless it's empty.
+func splitBucketURI(uri, scheme string) (bucket, prefix string, err error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return "", "", err
+	}
+	if u.Scheme != scheme || u.Host == "" {
+		return "", "", fmt.Errorf("invalid %s URI %q", scheme, uri)
+	}
+	prefix = strings.TrimPrefix(u.Path, "/")
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	return u.Host, prefix, nil
+}
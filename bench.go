@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// benchMain runs fastserve bench, requesting paths from a target at a
+// concurrency for a while and reporting the latencies and throughput.
+func benchMain(args []string) {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	target := fs.String("target", "http://localhost:8080", "base URL of the server to load")
+	urlList := fs.String("urls", "", "file of paths or URLs to request, one per line, instead of the files listed by -files")
+	filesURL := fs.String("files", "", "URL of a /_/files listing whose paths are requested as often as their size weighs, -target/_/files by default")
+	concurrency := fs.Int("c", 16, "requests in flight at once")
+	duration := fs.Duration("d", 10*time.Second, "how long to run")
+	requests := fs.Int("n", 0, "stop after this many requests instead of after -d")
+	fs.Parse(args)
+
+	base := strings.TrimSuffix(*target, "/")
+	var pick func() string
+	if *urlList != "" {
+		urls, err := readURLList(*urlList, base)
+		if err != nil {
+			log.Fatal(err)
+		}
+		pick = func() string { return urls[rand.N(len(urls))] }
+	} else {
+		if *filesURL == "" {
+			*filesURL = base + "/_/files"
+		}
+		files, err := fetchListing(*filesURL)
+		if err != nil {
+			log.Fatal(err)
+		}
+		pick = weightedPicker(files, base)
+	}
+
+	var (
+		mu        sync.Mutex
+		latencies []time.Duration
+		statuses  = make(map[int]int)
+		errs      int
+		bytes     atomic.Int64
+		sent      atomic.Int64
+		wg        sync.WaitGroup
+	)
+	client := &http.Client{Transport: &http.Transport{MaxIdleConnsPerHost: *concurrency}}
+	start := time.Now()
+	deadline := start.Add(*duration)
+	for range *concurrency {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for time.Now().Before(deadline) || *requests > 0 {
+				if *requests > 0 && sent.Add(1) > int64(*requests) {
+					return
+				}
+				reqStart := time.Now()
+				resp, err := client.Get(pick())
+				var n int64
+				if err == nil {
+					n, err = io.Copy(io.Discard, resp.Body)
+					resp.Body.Close()
+				}
+				took := time.Since(reqStart)
+				bytes.Add(n)
+				mu.Lock()
+				if err != nil {
+					errs++
+				} else {
+					statuses[resp.StatusCode]++
+					latencies = append(latencies, took)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	printBench(time.Since(start), latencies, statuses, errs, bytes.Load())
+}
+
+// readURLList reads a -urls file, resolving paths against base.
+func readURLList(name, base string) ([]string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var urls []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if !strings.Contains(line, "://") {
+			line = base + "/" + strings.TrimPrefix(line, "/")
+		}
+		urls = append(urls, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(urls) == 0 {
+		return nil, fmt.Errorf("%s lists no URLs", name)
+	}
+	return urls, nil
+}
+
+func fetchListing(u string) ([]fileListing, error) {
+	resp, err := http.Get(u)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s, serve it with -public-files or pass -files or -urls", u, resp.Status)
+	}
+	var files []fileListing
+	if err := json.NewDecoder(resp.Body).Decode(&files); err != nil {
+		return nil, fmt.Errorf("%s: %v", u, err)
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("%s lists no files", u)
+	}
+	return files, nil
+}
+
+// weightedPicker returns a function picking the URL of one of the files,
+// each as likely as its share of their total size.
+func weightedPicker(files []fileListing, base string) func() string {
+	urls := make([]string, len(files))
+	cumulative := make([]int64, len(files))
+	var total int64
+	for i, f := range files {
+		urls[i] = base + (&url.URL{Path: "/" + f.Path}).EscapedPath()
+		total += max(f.Size, 1)
+		cumulative[i] = total
+	}
+	return func() string {
+		n := rand.N(total)
+		return urls[sort.Search(len(cumulative), func(i int) bool { return cumulative[i] > n })]
+	}
+}
+
+func printBench(elapsed time.Duration, latencies []time.Duration, statuses map[int]int, errs int, bytes int64) {
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	total := len(latencies) + errs
+	fmt.Printf("%d requests in %v, %.1f requests/s, %.1f MB/s\n", total, elapsed.Round(time.Millisecond),
+		float64(total)/elapsed.Seconds(), float64(bytes)/(1<<20)/elapsed.Seconds())
+	codes := make([]int, 0, len(statuses))
+	for code := range statuses {
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+	for _, code := range codes {
+		fmt.Printf("  %d: %d\n", code, statuses[code])
+	}
+	if errs > 0 {
+		fmt.Printf("  errors: %d\n", errs)
+	}
+	if len(latencies) == 0 {
+		return
+	}
+	percentile := func(p float64) time.Duration {
+		return latencies[min(int(p*float64(len(latencies))), len(latencies)-1)]
+	}
+	fmt.Printf("latency p50 %v, p90 %v, p99 %v, max %v\n",
+		percentile(0.5), percentile(0.9), percentile(0.99), latencies[len(latencies)-1])
+}
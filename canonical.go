@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bytes"
+	"html"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+var (
+	canonicalLink = regexp.MustCompile(`(?i)<link\s[^>]*rel=["']?canonical\b`)
+	ogURLMeta     = regexp.MustCompile(`(?i)<meta\s[^>]*property=["']?og:url\b`)
+)
+
+// canonicalLinker adds a <link rel="canonical"> under -canonical-url, and
+// with -og-url an og:url meta tag, to HTML files lacking them, so mirrors of
+// a site don't compete with it in search results.
+type canonicalLinker struct{ s *server }
+
+func (t canonicalLinker) applies(relPath string) bool {
+	return t.s.canonicalURL != "" && isHTML(relPath)
+}
+
+func (t canonicalLinker) transform(relPath string, content []byte) ([]byte, map[string]string, error) {
+	if t.s.canonicalURL == "" || !isHTML(relPath) {
+		return content, nil, nil
+	}
+	page := strings.TrimSuffix(relPath, "index.html")
+	u := url.URL{Path: "/" + page}
+	href := html.EscapeString(t.s.canonicalURL + u.EscapedPath())
+
+	var tags []byte
+	if !canonicalLink.Match(content) {
+		tags = append(tags, `<link rel="canonical" href="`+href+`">`...)
+	}
+	if t.s.ogURL && !ogURLMeta.Match(content) {
+		tags = append(tags, `<meta property="og:url" content="`+href+`">`...)
+	}
+	if tags == nil {
+		return content, nil, nil
+	}
+	found := injectionMarkers["head-end"].FindAllIndex(content, -1)
+	if found == nil {
+		return content, nil, nil
+	}
+	at := found[len(found)-1][0]
+	var b bytes.Buffer
+	b.Grow(len(content) + len(tags))
+	b.Write(content[:at])
+	b.Write(tags)
+	b.Write(content[at:])
+	return b.Bytes(), nil, nil
+}
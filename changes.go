@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// A changeSet lists the paths whose content changed in a refresh.
+type changeSet struct {
+	Added    []string `json:"added"`
+	Modified []string `json:"modified"`
+	Removed  []string `json:"removed"`
+}
+
+func (c changeSet) empty() bool {
+	return len(c.Added) == 0 && len(c.Modified) == 0 && len(c.Removed) == 0
+}
+
+// changed returns the added and modified paths.
+func (c changeSet) changed() []string {
+	return append(append([]string(nil), c.Added...), c.Modified...)
+}
+
+func diffCaches(old, next *fileIndex) changeSet {
+	var c changeSet
+	for path, entry := range next.all() {
+		if prev := old.get(path); prev == nil {
+			c.Added = append(c.Added, path)
+		} else if prev.hash != entry.hash {
+			c.Modified = append(c.Modified, path)
+		}
+	}
+	for path := range old.all() {
+		if next.get(path) == nil {
+			c.Removed = append(c.Removed, path)
+		}
+	}
+	return c
+}
+
+// onChange registers fn to be called after every refresh that changed
+// content. Callbacks run in order on the refreshing goroutine, so anything
+// slow must start its own.
+func (s *server) onChange(fn func(changeSet)) {
+	s.changeHooks = append(s.changeHooks, fn)
+}
+
+// keepChanges is how many refreshes /_/changes remembers.
+const keepChanges = 20
+
+type fileChange struct {
+	Path string `json:"path"`
+	Hash string `json:"hash"`
+}
+
+// refreshDiff is what a refresh changed, with the hashes of the new content
+// or, for removed files, of the content they had.
+type refreshDiff struct {
+	Version  int          `json:"version"`
+	At       time.Time    `json:"at"`
+	Added    []fileChange `json:"added"`
+	Modified []fileChange `json:"modified"`
+	Removed  []fileChange `json:"removed"`
+}
+
+// recordChanges remembers c for /_/changes. It must be called with s.mu
+// held, after s.version is updated.
+func (s *server) recordChanges(c changeSet, old, next *fileIndex) {
+	if c.empty() {
+		return
+	}
+	hashes := func(paths []string, cache *fileIndex) []fileChange {
+		changes := make([]fileChange, 0, len(paths))
+		for _, path := range paths {
+			changes = append(changes, fileChange{path, cache.get(path).hash})
+		}
+		return changes
+	}
+	d := refreshDiff{
+		Version:  s.version,
+		At:       time.Now(),
+		Added:    hashes(c.Added, next),
+		Modified: hashes(c.Modified, next),
+		Removed:  hashes(c.Removed, old),
+	}
+	s.changeLog = append(s.changeLog, d)
+	s.events.publish(d)
+	if len(s.changeLog) > keepChanges {
+		s.changeLog = s.changeLog[len(s.changeLog)-keepChanges:]
+	}
+}
+
+// handleChanges lists the changes of the last refreshes, oldest first, or
+// only those after the version given as ?since=.
+func (s *server) handleChanges(w http.ResponseWriter, r *http.Request) {
+	since := 0
+	if v := r.URL.Query().Get("since"); v != "" {
+		var err error
+		if since, err = strconv.Atoi(v); err != nil {
+			http.Error(w, "invalid since version", http.StatusBadRequest)
+			return
+		}
+	}
+	a := s.requestAccess(r)
+	s.mu.RLock()
+	diffs := []refreshDiff{}
+	for _, d := range s.changeLog {
+		if d.Version > since {
+			diffs = append(diffs, s.visibleDiff(a, d))
+		}
+	}
+	s.mu.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(diffs)
+}
+
+// visibleDiff leaves out of d the files currently hidden, as sidecars or
+// before their publish time, and those a doesn't allow, like /_/files. It
+// must be called with s.mu held.
+func (s *server) visibleDiff(a *fileAccess, d refreshDiff) refreshDiff {
+	d.Added, d.Modified, d.Removed = s.visibleChanges(a, d.Added), s.visibleChanges(a, d.Modified), s.visibleChanges(a, d.Removed)
+	return d
+}
+
+func (s *server) visibleChanges(a *fileAccess, changes []fileChange) []fileChange {
+	visible := make([]fileChange, 0, len(changes))
+	for _, c := range changes {
+		if s.visible(a, c.Path) {
+			visible = append(visible, c)
+		}
+	}
+	return visible
+}
+
+// visible reports whether a may see the change to the file at path. It
+// must be called with s.mu held.
+func (s *server) visible(a *fileAccess, path string) bool {
+	entry := s.cache.get(path)
+	if entry != nil {
+		if hidden, _ := s.hidden(path, entry); hidden {
+			return false
+		}
+	}
+	return a.allows(path, entry)
+}
+
+// publicChanges leaves out of c the files an anonymous client may not see,
+// for what's sent to third parties, like /_/changes does for a request.
+func (s *server) publicChanges(c changeSet) changeSet {
+	a := s.publicAccess()
+	filter := func(paths []string) []string {
+		var visible []string
+		for _, path := range paths {
+			if s.visible(a, path) {
+				visible = append(visible, path)
+			}
+		}
+		return visible
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return changeSet{Added: filter(c.Added), Modified: filter(c.Modified), Removed: filter(c.Removed)}
+}
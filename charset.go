@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+var declaredCharset = regexp.MustCompile(`(?i)(?:<meta[^>]+charset=|<\?xml[^>]+encoding=)["']?([\w.:-]+)`)
+
+// detectCharset guesses the encoding of text content from its byte order
+// mark, an in-document declaration, or whether it is valid UTF-8.
+func detectCharset(content []byte) string {
+	switch {
+	case bytes.HasPrefix(content, []byte{0xef, 0xbb, 0xbf}):
+		return "utf-8"
+	case bytes.HasPrefix(content, []byte{0xfe, 0xff}):
+		return "utf-16be"
+	case bytes.HasPrefix(content, []byte{0xff, 0xfe}):
+		return "utf-16le"
+	}
+	head := content[:min(len(content), 1024)]
+	if m := declaredCharset.FindSubmatch(head); m != nil {
+		return strings.ToLower(string(m[1]))
+	}
+	if utf8.Valid(content) {
+		return "utf-8"
+	}
+	return "iso-8859-1"
+}
+
+func isText(mediaType string) bool {
+	if strings.HasPrefix(mediaType, "text/") {
+		return true
+	}
+	switch mediaType {
+	case "application/javascript", "application/json", "application/xml", "image/svg+xml":
+		return true
+	}
+	return false
+}
+
+// textContentType returns the Content-Type of a text file including its
+// detected charset, or "" if the file isn't text.
+func textContentType(path string, content []byte) string {
+	mediaType, params, err := mime.ParseMediaType(mimeType(path, content))
+	if err != nil || !isText(mediaType) {
+		return ""
+	}
+	params["charset"] = detectCharset(content)
+	return mime.FormatMediaType(mediaType, params)
+}
+
+// mimeType returns the Content-Type http.ServeContent would use for a file.
+func mimeType(path string, content []byte) string {
+	if ctype := mime.TypeByExtension(filepath.Ext(path)); ctype != "" {
+		return ctype
+	}
+	return http.DetectContentType(content)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+)
+
+// runCheck reports how the files of srv loaded for fastserve check and,
+// with serveTest, requests each of them through handler as a client would,
+// reporting those not answered with 200, their content type and their
+// content. It returns the exit status, 1 if any file failed.
+func runCheck(srv *server, handler http.Handler, serveTest bool) int {
+	files := srv.listFiles(srv.fullAccess())
+	srv.mu.RLock()
+	stats := srv.refreshStats
+	srv.mu.RUnlock()
+	fmt.Printf("loaded %d files from %s, skipped %d\n", len(files), srv.dir, stats.Skipped)
+	if !serveTest {
+		return 0
+	}
+
+	scheme, host := "http", "localhost"
+	if srv.canonicalScheme != "" {
+		scheme = srv.canonicalScheme
+	}
+	if srv.canonicalHost != "" {
+		host = srv.canonicalHost
+	} else if len(srv.allowedHosts) > 0 && !strings.HasPrefix(srv.allowedHosts[0], "*.") {
+		host = srv.allowedHosts[0]
+	}
+	failed := 0
+	for _, f := range files {
+		u := &url.URL{Scheme: scheme, Host: host, Path: "/" + f.Path}
+		if problem := checkFile(srv, handler, u, f); problem != "" {
+			fmt.Printf("%s: %s\n", f.Path, problem)
+			failed++
+		}
+	}
+	fmt.Printf("%d of %d files failed\n", failed, len(files))
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// checkFile requests u, following redirects within the server, and returns
+// what's wrong with the response for f, or "".
+func checkFile(srv *server, handler http.Handler, u *url.URL, f fileListing) string {
+	var rec *httptest.ResponseRecorder
+	for redirects := 0; ; redirects++ {
+		rec = httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, u.String(), nil))
+		location := rec.Header().Get("Location")
+		if rec.Code/100 != 3 || location == "" || redirects == 5 {
+			break
+		}
+		next, err := u.Parse(location)
+		if err != nil || next.Host != u.Host {
+			break
+		}
+		u = next
+	}
+	if rec.Code != http.StatusOK {
+		return fmt.Sprintf("%d %s", rec.Code, http.StatusText(rec.Code))
+	}
+	if ctype := rec.Header().Get("Content-Type"); ctype != f.ContentType {
+		return fmt.Sprintf("content type %q, want %q", ctype, f.ContentType)
+	}
+	srv.mu.RLock()
+	entry := srv.cache.get(f.Path)
+	srv.mu.RUnlock()
+	// HTML stamped with a fresh nonce differs from the cached content.
+	if entry != nil && entry.scripts != nil {
+		return ""
+	}
+	sum := sha256.Sum256(rec.Body.Bytes())
+	if hash := hex.EncodeToString(sum[:]); hash != f.SHA256 {
+		return fmt.Sprintf("content hash %s, want %s", hash, f.SHA256)
+	}
+	return ""
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+type checksum struct {
+	SHA256 string `json:"sha256"`
+	Size   int64  `json:"size"`
+}
+
+// indexChecksums renders the /_/manifest document mapping every path served
+// publicly to its checksum. It must be called with s.mu held.
+func (s *server) indexChecksums() {
+	manifest := make(map[string]checksum, s.cache.len())
+	public := s.publicAccess()
+	for path, entry := range s.cache.all() {
+		if hidden, _ := s.hidden(path, entry); !hidden && public.allows(path, entry) {
+			manifest[path] = checksum{entry.hash, entry.size}
+		}
+	}
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		errorf("rendering /_/manifest, keeping the previous one: %v", err)
+		return
+	}
+	if !bytes.Equal(data, s.checksums) {
+		s.checksums = data
+		s.checksumsModTime = time.Now()
+	}
+}
+
+func (s *server) handleChecksums(w http.ResponseWriter, r *http.Request) {
+	s.mu.RLock()
+	data, modTime := s.checksums, s.checksumsModTime
+	s.mu.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	http.ServeContent(w, r, "manifest.json", modTime, bytes.NewReader(data))
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultCompressTypes are the -compress-types compressed by default: text
+// formats, as media types, type/* prefixes or extensions.
+const defaultCompressTypes = "text/*,application/javascript,application/json,application/manifest+json,application/xml,application/wasm,image/svg+xml,.map"
+
+// compressedExts are formats compressed already, which gain nothing from
+// gzip whatever -compress-types lists.
+var compressedExts = map[string]bool{
+	".jpg": true, ".jpeg": true, ".png": true, ".gif": true, ".webp": true, ".avif": true,
+	".woff": true, ".woff2": true,
+	".zip": true, ".gz": true, ".tgz": true, ".br": true, ".zst": true, ".xz": true, ".bz2": true, ".7z": true,
+	".mp4": true, ".webm": true, ".mov": true, ".mp3": true, ".ogg": true, ".m4a": true,
+}
+
+// compressible reports whether responses for a file of the content type
+// are gzipped under -compress and -compress-types.
+func (s *server) compressible(relPath, ctype string) bool {
+	if !s.compress {
+		return false
+	}
+	ext := strings.ToLower(filepath.Ext(relPath))
+	if compressedExts[ext] {
+		return false
+	}
+	mediaType, _, _ := strings.Cut(ctype, ";")
+	mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+	for _, t := range s.compressTypes {
+		switch {
+		case strings.HasPrefix(t, "."):
+			if ext == t {
+				return true
+			}
+		case strings.HasSuffix(t, "/*"):
+			if strings.HasPrefix(mediaType, strings.TrimSuffix(t, "*")) {
+				return true
+			}
+		case mediaType == t:
+			return true
+		}
+	}
+	return false
+}
+
+// compressEntry gzips the content of a compressible file when it's cached,
+// unless it's stamped with a nonce on every response, too small to gain
+// or barely shrinks. The gzip of identical content is shared.
+func (s *server) compressEntry(relPath string, entry *fileCache) {
+	ctype := entry.contentType
+	if ctype == "" {
+		ctype = mimeType(relPath, entry.content)
+	}
+	if entry.scripts != nil || len(entry.content) < 256 || !s.compressible(relPath, ctype) {
+		return
+	}
+	if held := s.loadContents[entry.hash]; held != nil && held != entry && held.gzipped != nil {
+		entry.gzipped = held.gzipped
+		return
+	}
+	var buf bytes.Buffer
+	gz, _ := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+	gz.Write(entry.content)
+	gz.Close()
+	if buf.Len() > len(entry.content)*7/8 {
+		return
+	}
+	entry.gzipped = buf.Bytes()
+	s.loadBytes += int64(len(entry.gzipped))
+}
+
+// accepts reports whether the Accept-Encoding of r allows a content
+// coding, such as gzip.
+func accepts(r *http.Request, coding string) bool {
+	for _, v := range r.Header.Values("Accept-Encoding") {
+		for _, part := range strings.Split(v, ",") {
+			c, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+			if c = strings.ToLower(strings.TrimSpace(c)); c != coding && c != "*" {
+				continue
+			}
+			if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+				if f, err := strconv.ParseFloat(q, 64); err == nil && f == 0 {
+					continue
+				}
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// gzipETag is the entity tag of the gzipped representation.
+func gzipETag(etag []string) []string {
+	if etag == nil {
+		return nil
+	}
+	return []string{strings.TrimSuffix(etag[0], `"`) + `-gzip"`}
+}
+
+// serveGzipped writes the gzip of a cached file compressed when it was
+// cached.
+func (s *server) serveGzipped(w http.ResponseWriter, r *http.Request, path string, cached *fileCache) {
+	h := w.Header()
+	h.Set("Content-Encoding", "gzip")
+	h["Content-Type"] = cached.headers.contentType
+	if cached.headers.etag != nil {
+		h["Etag"] = cached.headers.gzipETag
+	}
+	if plainRequest(r) {
+		if cached.headers.lastModified != nil {
+			h["Last-Modified"] = cached.headers.lastModified
+		}
+		h["Content-Length"] = cached.headers.gzipLength
+		w.WriteHeader(http.StatusOK)
+		if r.Method != http.MethodHead {
+			w.Write(cached.gzipped)
+		}
+		return
+	}
+	modTime := cached.modTime
+	if cached.headers.lastModified == nil {
+		modTime = time.Time{}
+	}
+	serveBytes(w, r, path, modTime, cached.gzipped)
+}
+
+var gzipWriters = sync.Pool{New: func() any { return gzip.NewWriter(nil) }}
+
+// gzipWriter gzips a response as it's written, for files streamed from
+// disk or stamped with a nonce, which aren't compressed when cached. Other
+// statuses than 200, such as 304, pass through unencoded.
+type gzipWriter struct {
+	http.ResponseWriter
+	gz          *gzip.Writer
+	wroteHeader bool
+	passthrough bool
+}
+
+func (w *gzipWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		if code == http.StatusOK {
+			w.Header().Del("Content-Length")
+		} else {
+			w.Header().Del("Content-Encoding")
+			w.passthrough = true
+		}
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *gzipWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.passthrough {
+		return w.ResponseWriter.Write(b)
+	}
+	if w.gz == nil {
+		w.gz = gzipWriters.Get().(*gzip.Writer)
+		w.gz.Reset(w.ResponseWriter)
+	}
+	return w.gz.Write(b)
+}
+
+// Close writes the end of the gzip stream.
+func (w *gzipWriter) Close() {
+	if w.gz != nil {
+		w.gz.Close()
+		gzipWriters.Put(w.gz)
+		w.gz = nil
+	}
+}
+
+func (w *gzipWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+)
+
+// siteConfig is a site declared in the -config file. A site with a host is
+// served for requests to it on -addr, and one with an addr on a listener of
+// its own, with its certificate if given. Flags overrides the command line
+// flags for the site only, such as its refresh interval, ignore pattern or
+// auth rules, other than the processFlags.
+type siteConfig struct {
+	Host  string         `json:"host"`
+	Dir   string         `json:"dir"`
+	Addr  string         `json:"addr"`
+	Cert  string         `json:"cert"`
+	Key   string         `json:"key"`
+	Flags map[string]any `json:"flags"`
+}
+
+// processFlags configure the process as a whole, or the main server's
+// source and what its refreshes notify, so a site can't override them.
+var processFlags = map[string]bool{
+	"addr": true, "dir": true, "config": true, "site": true,
+	"sync-from": true, "archive": true, "s3": true, "s3-region": true, "s3-endpoint": true,
+	"gcs": true, "gcs-credentials": true, "azure": true, "git": true, "git-branch": true, "git-dir": true, "manifest": true,
+	"public-url": true, "purge": true, "purge-zone": true, "warm-url": true, "warm-concurrency": true,
+	"webhook": true, "publish": true, "admin-addr": true, "admin-grpc": true,
+	"gomemlimit": true, "gogc": true, "timeout": true, "read-header-timeout": true, "idle-timeout": true,
+	"max-header-bytes": true, "keep-alive": true, "tls-cert": true, "tls-key": true, "tls-min-version": true,
+	"tls-ciphers": true, "tls-curves": true, "ocsp-staple": true, "mime-types": true,
+	"count-downloads": true, "download-counts": true, "bind-early": true, "fail-on-empty": true,
+	"log-level": true, "quiet": true, "log-output": true, "otlp-endpoint": true, "syslog-addr": true,
+	"serve-test": true, "debug-http": true, "debug-http-sample": true,
+}
+
+type config struct {
+	Sites []siteConfig `json:"sites"`
+}
+
+// loadConfig reads a -config file.
+func loadConfig(path string) (config, error) {
+	var c config
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return c, err
+	}
+	if err := json.Unmarshal(data, &c); err != nil {
+		return c, fmt.Errorf("%s: %v", path, err)
+	}
+	for i, sc := range c.Sites {
+		if sc.Dir == "" || sc.Host == "" && sc.Addr == "" {
+			return c, fmt.Errorf("%s: site %d needs a dir and a host or addr", path, i+1)
+		}
+		if (sc.Cert == "") != (sc.Key == "") {
+			return c, fmt.Errorf("%s: site %d needs both a cert and a key", path, i+1)
+		}
+		for name := range sc.Flags {
+			if processFlags[name] {
+				return c, fmt.Errorf("%s: site %d can't override -%s, which applies to the whole process", path, i+1, name)
+			}
+			// The middleware of a host on -addr are in the main server's order.
+			if name == "middleware" && sc.Addr == "" {
+				return c, fmt.Errorf("%s: site %d can only override -middleware on an addr of its own", path, i+1)
+			}
+		}
+	}
+	return c, nil
+}
+
+// withFlags calls fn with the command line flags overridden by flags,
+// restoring them afterwards. A list replaces the values of a repeatable
+// flag rather than adding to them.
+func withFlags(flags map[string]any, fn func() error) error {
+	restore := make(map[*flag.Flag]func())
+	defer func() {
+		for _, undo := range restore {
+			undo()
+		}
+	}()
+	for name, value := range flags {
+		f := flag.Lookup(name)
+		if f == nil {
+			return fmt.Errorf("unknown flag %q", name)
+		}
+		if l, ok := f.Value.(*listFlag); ok {
+			saved := *l
+			restore[f] = func() { *l = saved }
+			*l = nil
+		} else {
+			saved := f.Value.String()
+			restore[f] = func() { f.Value.Set(saved) }
+		}
+		values, ok := value.([]any)
+		if !ok {
+			values = []any{value}
+		}
+		for _, v := range values {
+			s := fmt.Sprint(v)
+			if n, ok := v.(float64); ok {
+				s = strconv.FormatFloat(n, 'f', -1, 64)
+			}
+			if err := f.Value.Set(s); err != nil {
+				return fmt.Errorf("flag %q: %v", name, err)
+			}
+		}
+	}
+	return fn()
+}
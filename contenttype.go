@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+type contentTypeRule struct {
+	pattern     *regexp.Regexp
+	contentType string
+}
+
+// parseContentTypeRules parses pattern=type rules, such as
+// /raw/*=text/plain, in the order they should be tried.
+func parseContentTypeRules(rules []string) ([]contentTypeRule, error) {
+	var parsed []contentTypeRule
+	for _, rule := range rules {
+		pattern, contentType, ok := strings.Cut(rule, "=")
+		if !ok || contentType == "" {
+			return nil, fmt.Errorf("invalid content type rule %q", rule)
+		}
+		re, err := compileGlob(pattern)
+		if err != nil {
+			return nil, err
+		}
+		parsed = append(parsed, contentTypeRule{re, contentType})
+	}
+	return parsed, nil
+}
+
+func (s *server) contentType(path string, content []byte) string {
+	for _, rule := range s.typeRules {
+		if rule.pattern.MatchString(path) {
+			return rule.contentType
+		}
+	}
+	return textContentType(path, content)
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// downloadCounts counts downloads of files matching patterns, such as
+// releases/*, saving the counts to a file every minute if they changed.
+type downloadCounts struct {
+	patterns []*regexp.Regexp
+	file     string
+
+	mu     sync.Mutex
+	counts map[string]int64
+	dirty  bool
+}
+
+// newDownloadCounts returns counts for patterns, resuming from those saved in
+// file if it exists.
+func newDownloadCounts(patterns []*regexp.Regexp, file string) (*downloadCounts, error) {
+	c := &downloadCounts{patterns: patterns, file: file, counts: make(map[string]int64)}
+	if file == "" {
+		return c, nil
+	}
+	content, err := os.ReadFile(file)
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return c, json.Unmarshal(content, &c.counts)
+}
+
+// count records a download of relPath if it matches. Range requests only
+// count when they start at the beginning, so that a download fetched in
+// pieces counts once.
+func (c *downloadCounts) count(r *http.Request, relPath string) {
+	if c == nil || r.Method != http.MethodGet || !matchAny(c.patterns, relPath) {
+		return
+	}
+	if rng := r.Header.Get("Range"); rng != "" && !strings.HasPrefix(rng, "bytes=0-") {
+		return
+	}
+	c.mu.Lock()
+	c.counts[relPath]++
+	c.dirty = true
+	c.mu.Unlock()
+}
+
+func (c *downloadCounts) save() error {
+	c.mu.Lock()
+	if !c.dirty {
+		c.mu.Unlock()
+		return nil
+	}
+	content, err := json.Marshal(c.counts)
+	c.dirty = false
+	c.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	tmp := c.file + ".tmp"
+	if err := os.WriteFile(tmp, content, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.file)
+}
+
+func (c *downloadCounts) saveEveryMinute() {
+	for {
+		time.Sleep(time.Minute)
+		if err := c.save(); err != nil {
+			errorf("saving download counts: %v", err)
+		}
+	}
+}
+
+// handleDownloadCounts serves the download counts as JSON.
+func (s *server) handleDownloadCounts(w http.ResponseWriter, r *http.Request) {
+	s.downloadCounts.mu.Lock()
+	body, err := json.Marshal(s.downloadCounts.counts)
+	s.downloadCounts.mu.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
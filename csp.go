@@ -0,0 +1,37 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"regexp"
+	"strings"
+)
+
+var scriptTag = regexp.MustCompile(`(?i)<script\b`)
+
+// splitScripts splits content right after every opening script tag, so that
+// a nonce attribute can be stamped in between the parts on each response.
+func splitScripts(content []byte) [][]byte {
+	var parts [][]byte
+	prev := 0
+	for _, loc := range scriptTag.FindAllIndex(content, -1) {
+		parts = append(parts, content[prev:loc[1]])
+		prev = loc[1]
+	}
+	return append(parts, content[prev:])
+}
+
+func stampNonce(parts [][]byte, nonce string) []byte {
+	return bytes.Join(parts, []byte(` nonce="`+nonce+`"`))
+}
+
+func newNonce() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+func cspHeader(policy, nonce string) string {
+	return strings.ReplaceAll(policy, "{nonce}", nonce)
+}
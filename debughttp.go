@@ -0,0 +1,57 @@
+package main
+
+import (
+	"math/rand/v2"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// debugHTTP selects the requests whose headers are logged: those for paths
+// matching -debug-http, a -debug-http-sample fraction of them.
+var debugHTTP struct {
+	paths  []*regexp.Regexp
+	sample float64
+}
+
+// redactedHeaders are logged without their values.
+var redactedHeaders = map[string]bool{"Authorization": true, "Proxy-Authorization": true, "Cookie": true, "Set-Cookie": true}
+
+func dumpHTTP(r *http.Request) bool {
+	if debugHTTP.paths == nil || !matchAny(debugHTTP.paths, strings.TrimPrefix(r.URL.Path, "/")) {
+		return false
+	}
+	return debugHTTP.sample >= 1 || rand.Float64() < debugHTTP.sample
+}
+
+// logExchange logs the request line and headers of r, and the status and
+// headers of its response.
+func logExchange(r *http.Request, status int, header http.Header) {
+	var b strings.Builder
+	b.WriteString(r.Method + " " + r.URL.RequestURI() + " " + r.Proto + " from " + r.RemoteAddr)
+	writeHeaders(&b, "> ", r.Header, "Host: "+r.Host)
+	b.WriteString("\n< " + strconv.Itoa(status) + " " + http.StatusText(status))
+	writeHeaders(&b, "< ", header, "")
+	infof("%s", b.String())
+}
+
+func writeHeaders(b *strings.Builder, prefix string, header http.Header, first string) {
+	if first != "" {
+		b.WriteString("\n" + prefix + first)
+	}
+	names := make([]string, 0, len(header))
+	for name := range header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, value := range header[name] {
+			if redactedHeaders[name] {
+				value = "[redacted]"
+			}
+			b.WriteString("\n" + prefix + name + ": " + value)
+		}
+	}
+}
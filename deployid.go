@@ -0,0 +1,28 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+)
+
+// checkDeployID reads the -deploy-id file and reports whether it's the same
+// as at the last load, so that walking the whole tree can be skipped. A
+// missing file never counts as unchanged.
+func (s *server) checkDeployID() (id []byte, unchanged bool) {
+	if s.deployIDFile == "" {
+		return nil, false
+	}
+	id, err := os.ReadFile(filepath.Join(s.dir, s.deployIDFile))
+	if err != nil {
+		return nil, false
+	}
+	return id, s.loaded() && s.deployID != nil && bytes.Equal(id, s.deployID)
+}
+
+// loaded reports whether the files were loaded before.
+func (s *server) loaded() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.version > 0
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+)
+
+// serveDownload streams the cached files under the directory prefix as a
+// zip, tar or tgz archive.
+func (s *server) serveDownload(w http.ResponseWriter, r *http.Request, prefix, format string) {
+	if format != "zip" && format != "tar" && format != "tgz" {
+		http.Error(w, "download must be zip, tar or tgz", http.StatusBadRequest)
+		return
+	}
+
+	type file struct {
+		name  string
+		entry *fileCache
+	}
+	var files []file
+	a := s.requestAccess(r)
+	s.mu.RLock()
+	for p, entry := range s.cache.all() {
+		if name, ok := strings.CutPrefix(p, prefix); ok {
+			if hidden, _ := s.hidden(p, entry); !hidden && a.allows(p, entry) {
+				files = append(files, file{name, entry})
+			}
+		}
+	}
+	s.mu.RUnlock()
+	if len(files) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].name < files[j].name })
+
+	base := path.Base("/" + strings.TrimSuffix(prefix, "/"))
+	if base == "/" {
+		base = "site"
+	}
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": base + "." + format}))
+
+	var err error
+	if format == "zip" {
+		w.Header().Set("Content-Type", "application/zip")
+		zw := zip.NewWriter(w)
+		for _, f := range files {
+			var fw io.Writer
+			if fw, err = zw.CreateHeader(&zip.FileHeader{Name: f.name, Method: zip.Deflate, Modified: f.entry.modTime}); err != nil {
+				break
+			}
+			if err = copyEntry(fw, f.entry); err != nil {
+				break
+			}
+		}
+		if err == nil {
+			err = zw.Close()
+		}
+	} else {
+		var out io.Writer = w
+		w.Header().Set("Content-Type", "application/x-tar")
+		if format == "tgz" {
+			w.Header().Set("Content-Type", "application/gzip")
+			gw := gzip.NewWriter(w)
+			defer gw.Close()
+			out = gw
+		}
+		tw := tar.NewWriter(out)
+		for _, f := range files {
+			hdr := &tar.Header{Name: f.name, Mode: 0o644, Size: f.entry.size, ModTime: f.entry.modTime}
+			if err = tw.WriteHeader(hdr); err != nil {
+				break
+			}
+			if err = copyEntry(tw, f.entry); err != nil {
+				break
+			}
+		}
+		if err == nil {
+			err = tw.Close()
+		}
+	}
+	if err != nil {
+		errorf("download %s %v", prefix, err)
+	}
+}
+
+// copyEntry writes the content of entry to w.
+func copyEntry(w io.Writer, entry *fileCache) error {
+	f, err := entry.open()
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	return err
+}
@@ -0,0 +1,19 @@
+//go:build fastserve_embed
+
+package main
+
+import (
+	"embed"
+	"io/fs"
+)
+
+// embeddedSite is the site directory, built into the binary with
+// go build -tags fastserve_embed.
+//
+//go:embed all:site
+var embeddedSite embed.FS
+
+func init() {
+	// Sub only fails for an invalid name.
+	embedded, _ = fs.Sub(embeddedSite, "site")
+}
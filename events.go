@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// eventHub fans the diff of every refresh out to the /_/events streams.
+type eventHub struct {
+	mu   sync.Mutex
+	subs map[chan refreshDiff]bool
+}
+
+func (h *eventHub) subscribe() chan refreshDiff {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.subs == nil {
+		h.subs = make(map[chan refreshDiff]bool)
+	}
+	ch := make(chan refreshDiff, 16)
+	h.subs[ch] = true
+	return ch
+}
+
+func (h *eventHub) unsubscribe(ch chan refreshDiff) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.subs[ch] {
+		delete(h.subs, ch)
+		close(ch)
+	}
+}
+
+// publish sends d to every subscriber without waiting. A subscriber too far
+// behind is dropped, and catches up through Last-Event-ID as it reconnects.
+func (h *eventHub) publish(d refreshDiff) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subs {
+		select {
+		case ch <- d:
+		default:
+			delete(h.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+type fileEvent struct {
+	Path    string `json:"path"`
+	Hash    string `json:"hash"`
+	Version int    `json:"version"`
+}
+
+// writeEvents writes an added, modified or removed event per file in d, with
+// the version as the event ID.
+func writeEvents(w io.Writer, d refreshDiff) error {
+	for _, kind := range []struct {
+		name    string
+		changes []fileChange
+	}{{"added", d.Added}, {"modified", d.Modified}, {"removed", d.Removed}} {
+		for _, c := range kind.changes {
+			data, err := json.Marshal(fileEvent{c.Path, c.Hash, d.Version})
+			if err != nil {
+				return err
+			}
+			if _, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", d.Version, kind.name, data); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// handleEvents streams file changes as server-sent events, first replaying
+// those after the Last-Event-ID a reconnecting client sends.
+func (s *server) handleEvents(w http.ResponseWriter, r *http.Request) {
+	rc := http.NewResponseController(w)
+	rc.SetWriteDeadline(time.Time{})
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store")
+
+	a := s.requestAccess(r)
+	ch := s.events.subscribe()
+	defer s.events.unsubscribe(ch)
+	var replay []refreshDiff
+	if last, err := strconv.Atoi(r.Header.Get("Last-Event-ID")); err == nil {
+		s.mu.RLock()
+		for _, d := range s.changeLog {
+			if d.Version > last {
+				replay = append(replay, s.visibleDiff(a, d))
+			}
+		}
+		s.mu.RUnlock()
+	}
+	w.WriteHeader(http.StatusOK)
+	sent := 0
+	for _, d := range replay {
+		if writeEvents(w, d) != nil {
+			return
+		}
+		sent = d.Version
+	}
+	rc.Flush()
+
+	keepalive := time.NewTicker(30 * time.Second)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepalive.C:
+			if _, err := io.WriteString(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+		case d, ok := <-ch:
+			if !ok {
+				return
+			}
+			if d.Version <= sent {
+				continue
+			}
+			s.mu.RLock()
+			d = s.visibleDiff(a, d)
+			s.mu.RUnlock()
+			if writeEvents(w, d) != nil {
+				return
+			}
+		}
+		rc.Flush()
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+const maxFeedItems = 20
+
+type rssFeed struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title         string    `xml:"title"`
+	Link          string    `xml:"link"`
+	Description   string    `xml:"description"`
+	LastBuildDate string    `xml:"lastBuildDate,omitempty"`
+	Items         []rssItem `xml:"item"`
+}
+
+type rssItem struct {
+	Title       string `xml:"title"`
+	Link        string `xml:"link"`
+	GUID        string `xml:"guid"`
+	PubDate     string `xml:"pubDate"`
+	Description string `xml:"description,omitempty"`
+}
+
+// indexFeed renders the RSS feed of the newest markdown files with a title
+// and date in their metadata. It must be called with s.mu held.
+func (s *server) indexFeed() {
+	type post struct {
+		item rssItem
+		date time.Time
+	}
+	var posts []post
+	public := s.publicAccess()
+	for path, entry := range s.cache.all() {
+		if !strings.HasSuffix(strings.ToLower(path), ".md") {
+			continue
+		}
+		if hidden, _ := s.hidden(path, entry); hidden || !public.allows(path, entry) {
+			continue
+		}
+		m := s.meta(path, entry)
+		if m.title == "" || m.date.IsZero() {
+			continue
+		}
+		u := url.URL{Path: "/" + path}
+		link := s.canonicalURL + u.EscapedPath()
+		posts = append(posts, post{rssItem{m.title, link, link, m.date.Format(time.RFC1123Z), m.summary}, m.date})
+	}
+	sort.Slice(posts, func(i, j int) bool { return posts[i].date.After(posts[j].date) })
+	if len(posts) > maxFeedItems {
+		posts = posts[:maxFeedItems]
+	}
+
+	title := s.feedTitle
+	if title == "" {
+		title = s.canonicalURL
+	}
+	feed := rssFeed{Version: "2.0", Channel: rssChannel{Title: title, Link: s.canonicalURL + "/", Description: title}}
+	for _, p := range posts {
+		feed.Channel.Items = append(feed.Channel.Items, p.item)
+	}
+	if len(posts) > 0 {
+		feed.Channel.LastBuildDate = posts[0].item.PubDate
+	}
+	data, err := xml.MarshalIndent(feed, "", "  ")
+	if err != nil {
+		errorf("rendering the feed, keeping the previous one: %v", err)
+		return
+	}
+	data = append([]byte(xml.Header), data...)
+	if !bytes.Equal(data, s.feed) {
+		s.feed = data
+		s.feedModTime = time.Now()
+	}
+}
+
+func (s *server) handleFeed(w http.ResponseWriter, r *http.Request) {
+	s.mu.RLock()
+	data, modTime := s.feed, s.feedModTime
+	s.mu.RUnlock()
+
+	w.Header().Set("Content-Type", "application/rss+xml; charset=utf-8")
+	http.ServeContent(w, r, "feed.xml", modTime, bytes.NewReader(data))
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+)
+
+type fileListing struct {
+	Path        string    `json:"path"`
+	Size        int64     `json:"size"`
+	ModTime     time.Time `json:"modTime"`
+	SHA256      string    `json:"sha256"`
+	ContentType string    `json:"contentType"`
+}
+
+// handleFiles lists the cached files as JSON.
+func (s *server) handleFiles(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.listFiles(s.requestAccess(r)))
+}
+
+// listFiles returns the cached files that aren't hidden and a allows,
+// sorted by path.
+func (s *server) listFiles(a *fileAccess) []fileListing {
+	s.mu.RLock()
+	files := make([]fileListing, 0, s.cache.len())
+	for path, entry := range s.cache.all() {
+		if hidden, _ := s.hidden(path, entry); hidden || !a.allows(path, entry) {
+			continue
+		}
+		ctype := entry.contentType
+		if ctype == "" {
+			ctype = mimeType(path, entry.content)
+		}
+		files = append(files, fileListing{
+			Path:        path,
+			Size:        entry.size,
+			ModTime:     entry.modTime,
+			SHA256:      entry.hash,
+			ContentType: ctype,
+		})
+	}
+	s.mu.RUnlock()
+	sort.Slice(files, func(i, j int) bool { return files[i].Path < files[j].Path })
+	return files
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"strings"
+)
+
+// forwardAuth asks s.forwardAuthURL whether to serve each request for a path
+// matching s.forwardAuthPaths, or any path if none were given, passing along
+// the request's headers and what it was for in X-Forwarded-* headers, as
+// Traefik's forwardAuth and nginx's auth_request do. A 2xx answer lets the
+// request through, with the s.forwardAuthHeaders from the answer copied into
+// it; any other answer is relayed to the client as is. The endpoint is asked
+// about every request, as its decision and headers may differ by path.
+func (s *server) forwardAuth(next http.HandlerFunc) http.HandlerFunc {
+	if s.forwardAuthURL == "" {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if len(s.forwardAuthPaths) > 0 && !matchAny(s.forwardAuthPaths, protectedPath(r.URL.Path)) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, s.forwardAuthURL, nil)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		req.Header = r.Header.Clone()
+		req.Header.Set("X-Forwarded-Method", r.Method)
+		req.Header.Set("X-Forwarded-Proto", s.requestScheme(r))
+		req.Header.Set("X-Forwarded-Host", r.Host)
+		req.Header.Set("X-Forwarded-Uri", r.URL.RequestURI())
+		req.Header.Set("X-Forwarded-For", s.clientIP(r))
+		client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		}}
+		resp, err := client.Do(req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode/100 == 2 {
+			for _, name := range s.forwardAuthHeaders {
+				if v := resp.Header.Values(name); len(v) > 0 {
+					r.Header[http.CanonicalHeaderKey(name)] = v
+				}
+			}
+			w.Header().Set("Cache-Control", "private")
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+			s.logViolation(r, "auth-failed")
+		}
+		for name, v := range resp.Header {
+			if !strings.EqualFold(name, "Content-Length") {
+				w.Header()[name] = v
+			}
+		}
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, resp.Body)
+	}
+}
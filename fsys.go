@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"regexp"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// embedded is the directory built into the binary with the fastserve_embed
+// build tag, served when no -dir or other source is given. It's nil
+// otherwise.
+var embedded fs.FS
+
+// newFSServer returns a server caching the files of fsys, such as an
+// embed.FS, instead of a directory on disk.
+func newFSServer(fsys fs.FS) *server {
+	s := newServer(".")
+	s.fsys = fsys
+	return s
+}
+
+func (s *server) loadFS(ignore regexp.Regexp) error {
+	next := make(map[string]*fileCache)
+	skipped := 0
+	if err := fs.WalkDir(s.fsys, ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if path == "." {
+				return err
+			}
+			s.skip(path, err)
+			skipped++
+			return nil
+		}
+		if d.IsDir() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			s.skip(path, err)
+			skipped++
+			return nil
+		}
+		if err := s.visit(next, norm.NFC.String(path), info, "", ignore, func() ([]byte, error) {
+			return fs.ReadFile(s.fsys, path)
+		}); err != nil {
+			s.skip(path, err)
+			skipped++
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	s.swap(next, skipped)
+	return nil
+}
+
+// visit adds a regular file read from a source other than a directory on
+// disk to next, reusing its cached entry if it's unchanged since the last
+// load, unless the file is filtered out. version identifies the content where
+// the source offers it, such as an S3 ETag, and is compared instead of the
+// modification time. A file that can't be read isn't added, nor one that
+// doesn't fit under -max-memory, as there's no disk to stream it from.
+func (s *server) visit(next map[string]*fileCache, relPath string, info fs.FileInfo, version string, ignore regexp.Regexp, read func() ([]byte, error)) error {
+	if !info.Mode().IsRegular() {
+		return nil
+	}
+	if s.filtered(relPath, info, ignore) {
+		s.oversized(relPath, info, ignore)
+		return nil
+	}
+
+	s.mu.RLock()
+	cached, exists := s.cache.lookup(relPath)
+	s.mu.RUnlock()
+	if exists && (version == "" && info.ModTime().Equal(cached.sourceModTime) || version != "" && version == cached.version) {
+		s.loadBytes += int64(len(cached.content) + len(cached.gzipped))
+		s.share(cached, true)
+		next[relPath] = cached
+		return nil
+	}
+
+	// A size under 0 is unknown until the file is read, as for a
+	// -manifest, and reserved then.
+	if info.Size() >= 0 && !s.reserve(info.Size()) {
+		s.overMaxMemory(relPath, info.Size())
+		return nil
+	}
+	debugf("caching %s", relPath)
+	content, err := read()
+	if err != nil {
+		return err
+	}
+	if info.Size() < 0 && !s.reserve(int64(len(content))) {
+		s.overMaxMemory(relPath, int64(len(content)))
+		return nil
+	}
+	entry := s.newEntry(relPath, content, info.ModTime())
+	entry.version = version
+	next[relPath] = keepModTime(entry, cached)
+	return nil
+}
+
+func (s *server) overMaxMemory(relPath string, size int64) {
+	debugf("not caching %s over -max-memory", relPath)
+	s.addProblem(relPath, "over-max-memory", fmt.Sprintf("%d bytes, over -max-memory with no disk to stream from", size))
+}
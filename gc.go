@@ -0,0 +1,23 @@
+package main
+
+import (
+	"runtime/debug"
+)
+
+// tuneGC applies -gomemlimit and -gogc. Most of the heap is the cache, which
+// only changes on refreshes, so a high or disabled GOGC with a memory limit
+// keeps the collector from rescanning it after every small allocation burst.
+func tuneGC(memLimit string, gcPercent int) error {
+	if memLimit != "" {
+		limit, err := parseSize(memLimit)
+		if err != nil {
+			return err
+		}
+		debug.SetMemoryLimit(limit)
+		infof("memory limit %d bytes", limit)
+	}
+	if gcPercent != 0 {
+		debug.SetGCPercent(gcPercent)
+	}
+	return nil
+}
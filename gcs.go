@@ -0,0 +1,213 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// gcsClient talks to the Google Cloud Storage JSON API, authenticating with
+// a service account key file if one is configured.
+type gcsClient struct {
+	bucket string
+	prefix string
+
+	account *gcsServiceAccount
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+type gcsServiceAccount struct {
+	ClientEmail string `json:"client_email"`
+	PrivateKey  string `json:"private_key"`
+	TokenURI    string `json:"token_uri"`
+}
+
+// newGCSClient returns a client for a gs://bucket/prefix URI. credentials is
+// the path to a service account key file, falling back to
+// GOOGLE_APPLICATION_CREDENTIALS, and an empty path means anonymous access.
+func newGCSClient(uri, credentials string) (*gcsClient, error) {
+	bucket, prefix, err := splitBucketURI(uri, "gs")
+	if err != nil {
+		return nil, err
+	}
+	c := &gcsClient{bucket: bucket, prefix: prefix}
+
+	if credentials == "" {
+		credentials = os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
+	}
+	if credentials != "" {
+		data, err := os.ReadFile(credentials)
+		if err != nil {
+			return nil, err
+		}
+		c.account = new(gcsServiceAccount)
+		if err := json.Unmarshal(data, c.account); err != nil {
+			return nil, fmt.Errorf("%s: %w", credentials, err)
+		}
+		if c.account.TokenURI == "" {
+			c.account.TokenURI = "https://oauth2.googleapis.com/token"
+		}
+	}
+	return c, nil
+}
+
+type gcsListResult struct {
+	Items []struct {
+		Name    string    `json:"name"`
+		Size    string    `json:"size"`
+		Updated time.Time `json:"updated"`
+		ETag    string    `json:"etag"`
+	} `json:"items"`
+	NextPageToken string `json:"nextPageToken"`
+}
+
+func (c *gcsClient) list(fn func(object) error) error {
+	token := ""
+	for {
+		query := url.Values{"prefix": {c.prefix}, "fields": {"items(name,size,updated,etag),nextPageToken"}}
+		if token != "" {
+			query.Set("pageToken", token)
+		}
+		resp, err := c.do("https://storage.googleapis.com/storage/v1/b/" + url.PathEscape(c.bucket) + "/o?" + query.Encode())
+		if err != nil {
+			return err
+		}
+		var result gcsListResult
+		err = json.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+		for _, item := range result.Items {
+			size, _ := strconv.ParseInt(item.Size, 10, 64)
+			err := fn(object{
+				key:     item.Name,
+				path:    strings.TrimPrefix(item.Name, c.prefix),
+				version: item.ETag,
+				size:    size,
+				modTime: item.Updated,
+			})
+			if err != nil {
+				return err
+			}
+		}
+		if result.NextPageToken == "" {
+			return nil
+		}
+		token = result.NextPageToken
+	}
+}
+
+func (c *gcsClient) get(key string) ([]byte, error) {
+	resp, err := c.do("https://storage.googleapis.com/storage/v1/b/" + url.PathEscape(c.bucket) + "/o/" + url.PathEscape(key) + "?alt=media")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return io.ReadAll(resp.Body)
+}
+
+func (c *gcsClient) do(u string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	if c.account != nil {
+		token, err := c.accessToken()
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("gcs GET %s: %s", req.URL.Path, resp.Status)
+	}
+	return resp, nil
+}
+
+// accessToken returns an OAuth2 access token for the service account,
+// exchanging a freshly signed JWT for a new one shortly before it expires.
+func (c *gcsClient) accessToken() (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.token != "" && time.Now().Before(c.expires) {
+		return c.token, nil
+	}
+
+	block, _ := pem.Decode([]byte(c.account.PrivateKey))
+	if block == nil {
+		return "", errors.New("gcs: invalid service account private key")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return "", err
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return "", errors.New("gcs: service account key is not RSA")
+	}
+
+	now := time.Now()
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"RS256","typ":"JWT"}`))
+	claims, err := json.Marshal(map[string]any{
+		"iss":   c.account.ClientEmail,
+		"scope": "https://www.googleapis.com/auth/devstorage.read_only",
+		"aud":   c.account.TokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+	unsigned := header + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := http.PostForm(c.account.TokenURI, url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {unsigned + "." + base64.RawURLEncoding.EncodeToString(signature)},
+	})
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("gcs token exchange: %s", resp.Status)
+	}
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", err
+	}
+	c.token = token.AccessToken
+	c.expires = now.Add(time.Duration(token.ExpiresIn)*time.Second - time.Minute)
+	return c.token, nil
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// geoRule allows or denies requests for matching paths by the country of the
+// client.
+type geoRule struct {
+	pattern   *regexp.Regexp
+	allow     bool
+	countries []string
+}
+
+// parseGeoRules parses pattern=allow:CC,... and pattern=deny:CC,... rules,
+// such as downloads/**=allow:US,CA, in the order they should be tried.
+func parseGeoRules(rules []string) ([]geoRule, error) {
+	var parsed []geoRule
+	for _, rule := range rules {
+		pattern, action, _ := strings.Cut(rule, "=")
+		verb, list, _ := strings.Cut(action, ":")
+		if verb != "allow" && verb != "deny" || list == "" {
+			return nil, fmt.Errorf("invalid geo rule %q", rule)
+		}
+		re, err := compileGlob(pattern)
+		if err != nil {
+			return nil, err
+		}
+		var countries []string
+		for _, c := range splitList(list) {
+			countries = append(countries, strings.ToUpper(c))
+		}
+		parsed = append(parsed, geoRule{re, verb == "allow", countries})
+	}
+	return parsed, nil
+}
+
+// geoDB is a MaxMind country or city database, reopened when the file
+// changes.
+type geoDB struct {
+	name    string
+	reader  atomic.Pointer[maxminddb.Reader]
+	modTime time.Time
+}
+
+func openGeoDB(name string) (*geoDB, error) {
+	db := &geoDB{name: name}
+	return db, db.open()
+}
+
+func (db *geoDB) open() error {
+	info, err := os.Stat(db.name)
+	if err != nil {
+		return err
+	}
+	// Read into memory rather than mapped, so lookups in flight on the
+	// previous database stay valid after a reload.
+	content, err := os.ReadFile(db.name)
+	if err != nil {
+		return err
+	}
+	reader, err := maxminddb.FromBytes(content)
+	if err != nil {
+		return err
+	}
+	db.reader.Store(reader)
+	db.modTime = info.ModTime()
+	return nil
+}
+
+// watch polls the database file for updates.
+func (db *geoDB) watch() {
+	for {
+		time.Sleep(time.Minute)
+		if info, err := os.Stat(db.name); err != nil || info.ModTime().Equal(db.modTime) {
+			continue
+		}
+		if err := db.open(); err != nil {
+			errorf("reloading GeoIP database: %v", err)
+			continue
+		}
+		infof("reloaded GeoIP database %s", db.name)
+	}
+}
+
+// country returns the ISO code of the country ip is in, or "" if unknown.
+func (db *geoDB) country(ip net.IP) string {
+	var record struct {
+		Country struct {
+			ISOCode string `maxminddb:"iso_code"`
+		} `maxminddb:"country"`
+	}
+	if err := db.reader.Load().Lookup(ip, &record); err != nil {
+		return ""
+	}
+	return record.Country.ISOCode
+}
+
+// restrictGeo answers requests for paths matching a geo rule with 451 if the
+// client's country isn't allowed by the first matching rule. Clients whose
+// country is unknown are only let through deny rules.
+func (s *server) restrictGeo(next http.HandlerFunc) http.HandlerFunc {
+	if s.geoDB == nil || len(s.geoRules) == 0 {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !s.geoAllows(strings.TrimPrefix(r.URL.Path, "/"), s.clientCountry(r)) {
+			http.Error(w, "not available in your country", http.StatusUnavailableForLegalReasons)
+			return
+		}
+		next.ServeHTTP(w, r)
+	}
+}
+
+// clientCountry returns the ISO code of the country r comes from, or "" if
+// unknown.
+func (s *server) clientCountry(r *http.Request) string {
+	return s.geoDB.country(net.ParseIP(s.clientIP(r)))
+}
+
+// geoAllows reports whether the first geo rule matching path, if any, lets
+// clients from country through.
+func (s *server) geoAllows(path, country string) bool {
+	for _, rule := range s.geoRules {
+		if rule.pattern.MatchString(path) {
+			return slices.Contains(rule.countries, country) == rule.allow
+		}
+	}
+	return true
+}
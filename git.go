@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// gitClient serves the tree of a branch from a bare clone kept up to date by
+// running git, reading blobs through a git cat-file --batch process.
+type gitClient struct {
+	url    string
+	branch string
+	dir    string
+
+	mu     sync.Mutex
+	commit string
+
+	in  io.WriteCloser
+	out *bufio.Reader
+}
+
+// newGitClient clones url into dir, or a temporary directory if dir is
+// empty, unless dir already holds a clone.
+func newGitClient(url, branch, dir string) (*gitClient, error) {
+	if dir == "" {
+		var err error
+		if dir, err = os.MkdirTemp("", "fastserve-git-"); err != nil {
+			return nil, err
+		}
+	}
+	c := &gitClient{url: url, branch: branch, dir: dir}
+	if _, err := os.Stat(filepath.Join(dir, "HEAD")); err == nil {
+		return c, nil
+	}
+	if _, err := c.git("clone", "--quiet", "--bare", "--single-branch", "--branch", branch, url, dir); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *gitClient) git(args ...string) ([]byte, error) {
+	cmd := exec.Command("git", append([]string{"-C", c.dir}, args...)...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("git %s: %v: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
+
+// revision returns the commit currently being served.
+func (c *gitClient) revision() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.commit
+}
+
+func (c *gitClient) list(fn func(object) error) error {
+	if _, err := c.git("fetch", "--quiet", "origin", "+refs/heads/"+c.branch+":refs/heads/"+c.branch); err != nil {
+		return err
+	}
+	out, err := c.git("log", "-1", "--format=%H %ct", c.branch)
+	if err != nil {
+		return err
+	}
+	commit, timestamp, _ := strings.Cut(strings.TrimSpace(string(out)), " ")
+	seconds, _ := strconv.ParseInt(timestamp, 10, 64)
+	modTime := time.Unix(seconds, 0)
+
+	tree, err := c.git("ls-tree", "-r", "-l", "-z", commit)
+	if err != nil {
+		return err
+	}
+
+	cmd := exec.Command("git", "-C", c.dir, "cat-file", "--batch")
+	if c.in, err = cmd.StdinPipe(); err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	c.out = bufio.NewReader(stdout)
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	defer func() {
+		c.in.Close()
+		cmd.Wait()
+	}()
+
+	for _, line := range strings.Split(strings.TrimSuffix(string(tree), "\x00"), "\x00") {
+		// <mode> SP <type> SP <object> SP <size> TAB <path>
+		meta, path, ok := strings.Cut(line, "\t")
+		fields := strings.Fields(meta)
+		if !ok || len(fields) != 4 || fields[1] != "blob" || fields[0] == "120000" {
+			continue
+		}
+		size, _ := strconv.ParseInt(fields[3], 10, 64)
+		if err := fn(object{key: fields[2], path: path, version: fields[2], size: size, modTime: modTime}); err != nil {
+			return err
+		}
+	}
+
+	c.mu.Lock()
+	c.commit = commit
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *gitClient) get(key string) ([]byte, error) {
+	if _, err := io.WriteString(c.in, key+"\n"); err != nil {
+		return nil, err
+	}
+	header, err := c.out.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	// <object> SP <type> SP <size> LF <contents> LF
+	fields := strings.Fields(header)
+	if len(fields) != 3 {
+		return nil, fmt.Errorf("git cat-file %s: %s", key, strings.TrimSpace(header))
+	}
+	size, err := strconv.Atoi(fields[2])
+	if err != nil {
+		return nil, err
+	}
+	content := make([]byte, size+1)
+	if _, err := io.ReadFull(c.out, content); err != nil {
+		return nil, err
+	}
+	return content[:size], nil
+}
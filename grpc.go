@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"regexp"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	grpcstatus "google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// control serves the fastserve.Control service of control.proto. Requests
+// and responses are Structs rather than generated messages, so there's no
+// code to generate; an Empty request decodes as an empty Struct.
+type control struct {
+	s      *server
+	ignore regexp.Regexp
+	purger *cdnPurger
+}
+
+func newControlServer(c *control) *grpc.Server {
+	g := grpc.NewServer()
+	g.RegisterService(&grpc.ServiceDesc{
+		ServiceName: "fastserve.Control",
+		HandlerType: (*any)(nil),
+		Methods: []grpc.MethodDesc{
+			{MethodName: "ListFiles", Handler: unary(c.listFiles)},
+			{MethodName: "Refresh", Handler: unary(c.refresh)},
+			{MethodName: "Purge", Handler: unary(c.purge)},
+			{MethodName: "Stats", Handler: unary(c.stats)},
+		},
+		Streams: []grpc.StreamDesc{
+			{StreamName: "StreamChanges", Handler: c.streamChanges, ServerStreams: true},
+		},
+		Metadata: "control.proto",
+	}, c)
+	return g
+}
+
+// unary adapts fn to a gRPC method handler.
+func unary[T any](fn func(context.Context, *structpb.Struct) (T, error)) grpc.MethodHandler {
+	return func(_ any, ctx context.Context, dec func(any) error, _ grpc.UnaryServerInterceptor) (any, error) {
+		req := new(structpb.Struct)
+		if err := dec(req); err != nil {
+			return nil, err
+		}
+		return fn(ctx, req)
+	}
+}
+
+// toStruct converts v to a Struct through its JSON encoding.
+func toStruct(v any) (*structpb.Struct, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var m map[string]any
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, err
+	}
+	return structpb.NewStruct(m)
+}
+
+func (c *control) listFiles(ctx context.Context, _ *structpb.Struct) (*structpb.Struct, error) {
+	return toStruct(map[string]any{"files": c.s.listFiles(c.s.fullAccess())})
+}
+
+func (c *control) refresh(ctx context.Context, _ *structpb.Struct) (*structpb.Struct, error) {
+	if err := c.s.refresh(c.ignore); errors.Is(err, errRefreshing) {
+		return nil, grpcstatus.Error(codes.Unavailable, err.Error())
+	} else if err != nil {
+		return nil, err
+	}
+	c.s.mu.RLock()
+	stats := c.s.refreshStats
+	c.s.mu.RUnlock()
+	return toStruct(stats)
+}
+
+func (c *control) purge(ctx context.Context, req *structpb.Struct) (*emptypb.Empty, error) {
+	var paths []string
+	for _, v := range req.GetFields()["paths"].GetListValue().GetValues() {
+		paths = append(paths, v.GetStringValue())
+	}
+	c.s.notFound.clear()
+	if c.purger != nil && len(paths) > 0 {
+		go c.purger.purge(changeSet{Modified: paths})
+	}
+	return &emptypb.Empty{}, nil
+}
+
+func (c *control) stats(ctx context.Context, _ *structpb.Struct) (*structpb.Struct, error) {
+	return toStruct(c.s.status())
+}
+
+func (c *control) streamChanges(_ any, stream grpc.ServerStream) error {
+	if err := stream.RecvMsg(new(structpb.Struct)); err != nil {
+		return err
+	}
+	ch := c.s.events.subscribe()
+	defer c.s.events.unsubscribe(ch)
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case d, ok := <-ch:
+			if !ok {
+				return nil
+			}
+			c.s.mu.RLock()
+			d = c.s.visibleDiff(c.s.fullAccess(), d)
+			c.s.mu.RUnlock()
+			msg, err := toStruct(d)
+			if err != nil {
+				return err
+			}
+			if err := stream.SendMsg(msg); err != nil {
+				return err
+			}
+		}
+	}
+}
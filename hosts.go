@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// allowedHost reports whether host is one of s.allowedHosts, which may start
+// with *. to match any subdomain, or of the sites. Any host is allowed if no
+// hosts were given.
+func (s *server) allowedHost(host string, sites []site) bool {
+	if len(s.allowedHosts) == 0 {
+		return true
+	}
+	for _, allowed := range s.allowedHosts {
+		if host == allowed || strings.HasPrefix(allowed, "*.") && strings.HasSuffix(host, allowed[1:]) {
+			return true
+		}
+	}
+	for _, st := range sites {
+		if host == st.host {
+			return true
+		}
+	}
+	return false
+}
+
+// checkHost answers requests for hosts that aren't allowed with 421.
+func (s *server) checkHost(sites *siteList, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !s.allowedHost(requestHost(r), sites.load()) {
+			s.logViolation(r, "unknown-host")
+			http.Error(w, "unknown host", http.StatusMisdirectedRequest)
+			return
+		}
+		next.ServeHTTP(w, r)
+	}
+}
+
+// requestScheme returns the scheme r was made with, as reported by
+// X-Forwarded-Proto if the connection comes from a trusted proxy.
+func (s *server) requestScheme(r *http.Request) string {
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto != "" {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if ip := net.ParseIP(host); err == nil && ip != nil && s.trusted(ip) {
+			return strings.ToLower(proto)
+		}
+	}
+	if r.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// redirectCanonical permanently redirects requests made for another host
+// than s.canonicalHost, or with another scheme than s.canonicalScheme, if
+// set. Requests for the sites and for the status endpoint are left alone.
+func (s *server) redirectCanonical(sites *siteList, next http.HandlerFunc) http.HandlerFunc {
+	if s.canonicalHost == "" && s.canonicalScheme == "" {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if sites.lookup(requestHost(r)) != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		u := url.URL{Scheme: s.requestScheme(r), Host: r.Host}
+		if s.canonicalHost != "" && strings.ToLower(r.Host) != s.canonicalHost {
+			u.Host = s.canonicalHost
+		}
+		if s.canonicalScheme != "" {
+			u.Scheme = s.canonicalScheme
+		}
+		if r.URL.Path == "/_/status" || u.Host == r.Host && u.Scheme == s.requestScheme(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		http.Redirect(w, r, u.String()+r.URL.RequestURI(), http.StatusMovedPermanently)
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// entryHeaders are the response header values of a cached file, built once
+// when it's cached so a plain hit doesn't format them on every request. The
+// content type is sniffed here for files without a known extension, rather
+// than by http.ServeContent on every request.
+type entryHeaders struct {
+	contentType   []string
+	lastModified  []string
+	contentLength []string
+	etag          []string
+	// gzipETag and gzipLength are those of the gzipped content, if any.
+	gzipETag   []string
+	gzipLength []string
+}
+
+var acceptRanges = []string{"bytes"}
+
+func (s *server) entryHeaders(relPath string, entry *fileCache) entryHeaders {
+	ctype := entry.contentType
+	if ctype == "" {
+		ctype = mimeType(relPath, entry.content)
+	}
+	h := entryHeaders{
+		contentType:   []string{ctype},
+		contentLength: []string{strconv.FormatInt(entry.size, 10)},
+	}
+	v := s.validators(relPath)
+	// HTML stamped with a fresh nonce differs on every response, so it has
+	// no validators: a 304 would pair the cached body's old nonce with the
+	// new one of the CSP header, blocking its scripts.
+	if v.etag && entry.scripts == nil {
+		etag := `"` + entry.hash + `"`
+		if v.weak {
+			etag = "W/" + etag
+		}
+		h.etag = []string{etag}
+	}
+	if entry.gzipped != nil {
+		h.gzipETag = gzipETag(h.etag)
+		h.gzipLength = []string{strconv.Itoa(len(entry.gzipped))}
+	}
+	if v.lastModified && entry.scripts == nil && !entry.modTime.IsZero() && !entry.modTime.Equal(time.Unix(0, 0)) {
+		h.lastModified = []string{entry.modTime.UTC().Format(http.TimeFormat)}
+	}
+	return h
+}
+
+// servePlain writes a cached file with its prebuilt headers, the way
+// http.ServeContent would, if the request is a plain GET or HEAD without
+// ranges or preconditions, and reports whether it did.
+func (s *server) servePlain(w http.ResponseWriter, r *http.Request, cached *fileCache) bool {
+	if !plainRequest(r) {
+		return false
+	}
+	if cached.file != "" {
+		return s.streamPlain(w, r, cached)
+	}
+	writePlainHeaders(w, cached)
+	w.WriteHeader(http.StatusOK)
+	if r.Method != http.MethodHead {
+		w.Write(cached.content)
+	}
+	return true
+}
+
+// plainRequest reports whether r is a GET or HEAD without ranges or
+// preconditions.
+func plainRequest(r *http.Request) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	for _, name := range []string{"Range", "If-Match", "If-None-Match", "If-Modified-Since", "If-Unmodified-Since"} {
+		if _, ok := r.Header[name]; ok {
+			return false
+		}
+	}
+	return true
+}
+
+func writePlainHeaders(w http.ResponseWriter, cached *fileCache) {
+	h := w.Header()
+	h["Content-Type"] = cached.headers.contentType
+	if cached.headers.etag != nil {
+		h["Etag"] = cached.headers.etag
+	}
+	if cached.headers.lastModified != nil {
+		h["Last-Modified"] = cached.headers.lastModified
+	}
+	h["Accept-Ranges"] = acceptRanges
+	if _, encoded := h["Content-Encoding"]; !encoded {
+		h["Content-Length"] = cached.headers.contentLength
+	}
+}
+
+var readerPool = sync.Pool{New: func() any { return new(bytes.Reader) }}
+
+// serveBytes is http.ServeContent over content with a pooled reader.
+func serveBytes(w http.ResponseWriter, r *http.Request, name string, modTime time.Time, content []byte) {
+	reader := readerPool.Get().(*bytes.Reader)
+	reader.Reset(content)
+	http.ServeContent(w, r, name, modTime, reader)
+	reader.Reset(nil)
+	readerPool.Put(reader)
+}
+
+var logBuffers = sync.Pool{New: func() any { b := make([]byte, 0, 256); return &b }}
+
+// logLine writes a request log line in the log package's default format
+// into a pooled buffer, as log.Printf would box and format every argument.
+func logLine(method, path string, elapsed time.Duration) {
+	if sink != nil {
+		emit(levelInfo, method+" "+path+" "+strconv.FormatFloat(float64(elapsed.Microseconds())/1000, 'f', 3, 64)+"ms")
+		return
+	}
+	buf := logBuffers.Get().(*[]byte)
+	b := time.Now().AppendFormat((*buf)[:0], "2006/01/02 15:04:05 ")
+	b = append(b, method...)
+	b = append(b, ' ')
+	b = append(b, path...)
+	b = append(b, ' ')
+	b = strconv.AppendFloat(b, float64(elapsed.Microseconds())/1000, 'f', 3, 64)
+	b = append(b, "ms\n"...)
+	os.Stderr.Write(b)
+	*buf = b
+	logBuffers.Put(buf)
+}
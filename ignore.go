@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+type ignoreRule struct {
+	pattern *regexp.Regexp
+	negate  bool
+	dirOnly bool
+}
+
+// ignoreFiles holds the rules of the gitignore-style ignore files found so
+// far during a walk, keyed by the relative directory they were found in.
+type ignoreFiles map[string][]ignoreRule
+
+func (f ignoreFiles) load(path, relDir string) error {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), " \t\r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		var rule ignoreRule
+		if rule.negate = strings.HasPrefix(line, "!"); rule.negate {
+			line = line[1:]
+		}
+		line = strings.TrimPrefix(line, `\`)
+		rule.dirOnly = strings.HasSuffix(line, "/")
+		if rule.pattern, err = compileGlob(line); err != nil {
+			return err
+		}
+		f[relDir] = append(f[relDir], rule)
+	}
+	return scanner.Err()
+}
+
+// match reports whether relPath is ignored. Rules in deeper directories and
+// later lines take precedence, like in gitignore.
+func (f ignoreFiles) match(relPath string, isDir bool) bool {
+	ignored := false
+	dir := "."
+	sub := relPath
+	for {
+		for _, rule := range f[dir] {
+			if rule.dirOnly && !isDir {
+				continue
+			}
+			if rule.pattern.MatchString(sub) {
+				ignored = !rule.negate
+			}
+		}
+		first, rest, ok := strings.Cut(sub, "/")
+		if !ok {
+			return ignored
+		}
+		if dir == "." {
+			dir = first
+		} else {
+			dir += "/" + first
+		}
+		sub = rest
+	}
+}
+
+func (s *server) loadIgnoreFile(ignores ignoreFiles, dir, relDir string) error {
+	if s.ignoreFile == "" {
+		return nil
+	}
+	return ignores.load(filepath.Join(dir, s.ignoreFile), relDir)
+}
+
+// parseGlobs compiles comma-separated lists of glob patterns.
+func parseGlobs(lists []string) ([]*regexp.Regexp, error) {
+	var globs []*regexp.Regexp
+	for _, list := range lists {
+		for _, pattern := range strings.Split(list, ",") {
+			if pattern == "" {
+				continue
+			}
+			re, err := compileGlob(pattern)
+			if err != nil {
+				return nil, err
+			}
+			globs = append(globs, re)
+		}
+	}
+	return globs, nil
+}
+
+// included reports whether relPath matches the -only allowlist, if any.
+func (s *server) included(relPath string) bool {
+	return len(s.only) == 0 || matchAny(s.only, relPath)
+}
+
+func matchAny(globs []*regexp.Regexp, path string) bool {
+	for _, re := range globs {
+		if re.MatchString(path) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseSize parses a byte size such as 512, 64KB or 50MB.
+func parseSize(size string) (int64, error) {
+	units := []struct {
+		suffix string
+		factor int64
+	}{{"KB", 1 << 10}, {"MB", 1 << 20}, {"GB", 1 << 30}, {"K", 1 << 10}, {"M", 1 << 20}, {"G", 1 << 30}, {"B", 1}}
+	number, factor := strings.ToUpper(strings.TrimSpace(size)), int64(1)
+	for _, unit := range units {
+		if n, ok := strings.CutSuffix(number, unit.suffix); ok {
+			number, factor = n, unit.factor
+			break
+		}
+	}
+	var n int64
+	if _, err := fmt.Sscan(number, &n); err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", size)
+	}
+	return n * factor, nil
+}
+
+// excluded reports whether a file is excluded by its extension or size.
+func (s *server) excluded(relPath string, info os.FileInfo) bool {
+	if s.maxFileSize > 0 && info.Size() > s.maxFileSize {
+		return true
+	}
+	return s.ignoreExts[strings.ToLower(filepath.Ext(relPath))]
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"iter"
+	"sort"
+	"strings"
+)
+
+// fileIndex is the cache of a load, built once and only read after. The
+// paths are packed, sorted, into one string and found by binary search,
+// with the entries in an array beside them, so a tree of millions of small
+// files costs no map buckets or string allocations per path, and lookups
+// allocate nothing. The zero value is empty.
+type fileIndex struct {
+	names   string
+	ends    []uint32
+	entries []*fileCache
+	// siblings are the precompressed siblings of the files.
+	siblings map[string]precompressed
+}
+
+func newFileIndex(files map[string]*fileCache) *fileIndex {
+	paths := make([]string, 0, len(files))
+	size := 0
+	for path := range files {
+		paths = append(paths, path)
+		size += len(path)
+	}
+	sort.Strings(paths)
+
+	var names strings.Builder
+	names.Grow(size)
+	idx := &fileIndex{
+		ends:    make([]uint32, len(paths)),
+		entries: make([]*fileCache, len(paths)),
+	}
+	for i, path := range paths {
+		names.WriteString(path)
+		idx.ends[i] = uint32(names.Len())
+		idx.entries[i] = files[path]
+	}
+	idx.names = names.String()
+	return idx
+}
+
+func (idx *fileIndex) len() int {
+	if idx == nil {
+		return 0
+	}
+	return len(idx.entries)
+}
+
+func (idx *fileIndex) path(i int) string {
+	start := uint32(0)
+	if i > 0 {
+		start = idx.ends[i-1]
+	}
+	return idx.names[start:idx.ends[i]]
+}
+
+// get returns the entry of path, or nil.
+func (idx *fileIndex) get(path string) *fileCache {
+	entry, _ := idx.lookup(path)
+	return entry
+}
+
+// lookup returns the entry of path and whether there's one.
+func (idx *fileIndex) lookup(path string) (*fileCache, bool) {
+	lo, hi := 0, idx.len()
+	for lo < hi {
+		mid := int(uint(lo+hi) >> 1)
+		if idx.path(mid) < path {
+			lo = mid + 1
+		} else {
+			hi = mid
+		}
+	}
+	if lo < idx.len() && idx.path(lo) == path {
+		return idx.entries[lo], true
+	}
+	return nil, false
+}
+
+// all yields the paths and entries in path order.
+func (idx *fileIndex) all() iter.Seq2[string, *fileCache] {
+	return func(yield func(string, *fileCache) bool) {
+		for i := range idx.len() {
+			if !yield(idx.path(i), idx.entries[i]) {
+				return
+			}
+		}
+	}
+}
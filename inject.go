@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// injection is a snippet inserted into HTML files at a position: head-start,
+// head-end, body-start or body-end.
+type injection struct {
+	position string
+	snippet  []byte
+}
+
+var injectionMarkers = map[string]*regexp.Regexp{
+	"head-start": regexp.MustCompile(`(?i)<head(\s[^>]*)?>`),
+	"head-end":   regexp.MustCompile(`(?i)</head>`),
+	"body-start": regexp.MustCompile(`(?i)<body(\s[^>]*)?>`),
+	"body-end":   regexp.MustCompile(`(?i)</body>`),
+}
+
+// parseInjections parses position=file injections, reading the snippets.
+func parseInjections(specs []string) ([]injection, error) {
+	var parsed []injection
+	for _, spec := range specs {
+		position, name, ok := strings.Cut(spec, "=")
+		if _, known := injectionMarkers[position]; !ok || !known {
+			return nil, fmt.Errorf("invalid injection %q, want head-start, head-end, body-start or body-end=file", spec)
+		}
+		snippet, err := os.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+		parsed = append(parsed, injection{position, snippet})
+	}
+	return parsed, nil
+}
+
+// injector inserts the -inject snippets into HTML files.
+type injector struct{ s *server }
+
+func (t injector) applies(relPath string) bool {
+	return len(t.s.injections) > 0 && isHTML(relPath)
+}
+
+func (t injector) transform(relPath string, content []byte) ([]byte, map[string]string, error) {
+	if !isHTML(relPath) {
+		return content, nil, nil
+	}
+	for _, inj := range t.s.injections {
+		found := injectionMarkers[inj.position].FindAllIndex(content, -1)
+		if found == nil {
+			continue
+		}
+		// After the first opening tag, or before the last closing one, in
+		// case an earlier one is in a comment or script.
+		at := found[0][1]
+		if strings.HasSuffix(inj.position, "-end") {
+			at = found[len(found)-1][0]
+		}
+		var b bytes.Buffer
+		b.Grow(len(content) + len(inj.snippet))
+		b.Write(content[:at])
+		b.Write(inj.snippet)
+		b.Write(content[at:])
+		content = b.Bytes()
+	}
+	return content, nil, nil
+}
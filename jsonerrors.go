@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// jsonErrors renders plain text error responses to requests under
+// s.jsonErrorPrefixes as {"error": ..., "status": ...} for API clients.
+func (s *server) jsonErrors(next http.HandlerFunc) http.HandlerFunc {
+	if len(s.jsonErrorPrefixes) == 0 {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		for _, prefix := range s.jsonErrorPrefixes {
+			if strings.HasPrefix(r.URL.Path, prefix) {
+				jw := &jsonErrorWriter{ResponseWriter: w}
+				next.ServeHTTP(jw, r)
+				jw.flush()
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	}
+}
+
+// jsonErrorWriter holds back plain text error responses to rewrite them.
+type jsonErrorWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (w *jsonErrorWriter) WriteHeader(code int) {
+	if code >= 400 && strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain") {
+		w.status = code
+		return
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *jsonErrorWriter) Write(b []byte) (int, error) {
+	if w.status != 0 {
+		return w.body.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// ReadFrom passes files through to the connection, keeping sendfile.
+func (w *jsonErrorWriter) ReadFrom(src io.Reader) (int64, error) {
+	if w.status != 0 {
+		return w.body.ReadFrom(src)
+	}
+	return io.Copy(w.ResponseWriter, src)
+}
+
+func (w *jsonErrorWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *jsonErrorWriter) flush() {
+	if w.status == 0 {
+		return
+	}
+	body, _ := json.Marshal(struct {
+		Error  string `json:"error"`
+		Status int    `json:"status"`
+	}{strings.TrimSpace(w.body.String()), w.status})
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)+1))
+	w.ResponseWriter.WriteHeader(w.status)
+	w.ResponseWriter.Write(append(body, '\n'))
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// jwksRefetchInterval is how often a JSON Web Key Set is fetched again at
+// most, so that tokens with made-up key IDs can't make every request wait
+// on a fetch.
+const jwksRefetchInterval = time.Minute
+
+// jwks is a JSON Web Key Set fetched from a URL.
+type jwks struct {
+	url string
+
+	mu      sync.Mutex
+	keys    map[string]crypto.PublicKey
+	fetched time.Time
+	// fetching is closed once the fetch in progress, if any, is done.
+	fetching chan struct{}
+	err      error
+}
+
+// jwksClient fetches key sets, with a timeout so that requests waiting on
+// a key don't hang on a slow issuer.
+var jwksClient = &http.Client{Timeout: 10 * time.Second}
+
+// key returns the key with the given ID, fetching the set again if it's
+// unknown, as after the issuer rotated its keys, unless it was fetched less
+// than jwksRefetchInterval ago. Known keys are returned while the set is
+// being fetched, and requests for unknown ones wait for that fetch, until
+// ctx is done, rather than starting their own.
+func (set *jwks) key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	set.mu.Lock()
+	if key, ok := set.keys[kid]; ok {
+		set.mu.Unlock()
+		return key, nil
+	}
+	fetching := set.fetching
+	if fetching == nil {
+		if !set.fetched.IsZero() && time.Since(set.fetched) < jwksRefetchInterval {
+			err := set.err
+			set.mu.Unlock()
+			if err != nil {
+				return nil, err
+			}
+			return nil, fmt.Errorf("unknown signing key %q", kid)
+		}
+		fetching = make(chan struct{})
+		set.fetching = fetching
+		go set.fetch(fetching)
+	}
+	set.mu.Unlock()
+	select {
+	case <-fetching:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	set.mu.Lock()
+	key, ok := set.keys[kid]
+	err := set.err
+	set.mu.Unlock()
+	if ok {
+		return key, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+// fetch fetches the set again and closes done, keeping the keys it had if
+// the fetch fails. It runs apart from the requests waiting on it, so that
+// one giving up doesn't fail it for the others.
+func (set *jwks) fetch(done chan struct{}) {
+	keys, err := fetchJWKS(set.url)
+	set.mu.Lock()
+	if err == nil {
+		set.keys = keys
+	}
+	set.fetched, set.err, set.fetching = time.Now(), err, nil
+	set.mu.Unlock()
+	close(done)
+}
+
+func fetchJWKS(url string) (map[string]crypto.PublicKey, error) {
+	resp, err := jwksClient.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	var fetched struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(body, &fetched); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]crypto.PublicKey)
+	for _, k := range fetched.Keys {
+		if key, err := k.publicKey(); err == nil {
+			keys[k.Kid] = key
+		}
+	}
+	return keys, nil
+}
+
+// jwk is a public key from a JSON Web Key Set.
+type jwk struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	field := func(s string) *big.Int {
+		b, _ := base64.RawURLEncoding.DecodeString(s)
+		return new(big.Int).SetBytes(b)
+	}
+	switch {
+	case k.Kty == "RSA":
+		return &rsa.PublicKey{N: field(k.N), E: int(field(k.E).Int64())}, nil
+	case k.Kty == "EC" && k.Crv == "P-256":
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: field(k.X), Y: field(k.Y)}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %s %s", k.Kty, k.Crv)
+}
+
+// parseJWT verifies a JWT signed with RS256 or ES256 by the key returned by
+// keyFor for its key ID, and returns its claims if it hasn't expired.
+func parseJWT(token string, keyFor func(kid string) (crypto.PublicKey, error)) (map[string]any, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, err
+	}
+	key, err := keyFor(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		if header.Alg != "RS256" || rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig) != nil {
+			return nil, errors.New("invalid signature")
+		}
+	case *ecdsa.PublicKey:
+		if header.Alg != "ES256" || len(sig) != 64 ||
+			!ecdsa.Verify(key, digest[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])) {
+			return nil, errors.New("invalid signature")
+		}
+	default:
+		return nil, errors.New("unsupported key")
+	}
+
+	var claims map[string]any
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	if exp, ok := claims["exp"].(float64); !ok || time.Now().Unix() >= int64(exp) {
+		return nil, errors.New("token expired")
+	}
+	return claims, nil
+}
+
+func decodeSegment(segment string, v any) error {
+	b, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// audience reports whether the aud claim, a string or a list, includes aud.
+func audience(claims map[string]any, aud string) bool {
+	return hasClaim(claims, "aud", aud)
+}
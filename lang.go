@@ -0,0 +1,106 @@
+package main
+
+import (
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/text/language"
+)
+
+var langTag = regexp.MustCompile(`^[a-z]{2}(-[a-z]{2})?$`)
+
+// notVariants are the extensions of files that are another form of the file
+// before them, such as app.js.gz, rather than a language variant of it.
+var notVariants = map[string]bool{".gz": true, ".br": true, ".zst": true, ".map": true}
+
+// splitLanguage reports the base path and language of a variant such as
+// index.de.html, which is a variant of index.html. The language must be an
+// ISO 639 code, with an ISO 3166 region if any, so that other second
+// extensions, such as those of app.js.gz, aren't taken for one.
+func splitLanguage(path string) (base, lang string, ok bool) {
+	ext := filepath.Ext(path)
+	stem := strings.TrimSuffix(path, ext)
+	lang = strings.ToLower(strings.TrimPrefix(filepath.Ext(stem), "."))
+	if !langTag.MatchString(lang) || notVariants[strings.ToLower(ext)] {
+		return "", "", false
+	}
+	primary, region, _ := strings.Cut(lang, "-")
+	if _, err := language.ParseBase(primary); err != nil {
+		return "", "", false
+	}
+	if region != "" {
+		if _, err := language.ParseRegion(region); err != nil {
+			return "", "", false
+		}
+	}
+	return strings.TrimSuffix(stem, filepath.Ext(stem)) + ext, lang, true
+}
+
+// indexLanguages groups language variants by their base path. It must be
+// called with s.mu held.
+func (s *server) indexLanguages() {
+	s.variants = make(map[string]map[string]string)
+	for path := range s.cache.all() {
+		base, lang, ok := splitLanguage(path)
+		if !ok {
+			continue
+		}
+		if s.variants[base] == nil {
+			s.variants[base] = make(map[string]string)
+		}
+		s.variants[base][lang] = path
+	}
+}
+
+type languagePreference struct {
+	tag string
+	q   float64
+}
+
+func parseAcceptLanguage(header string) []languagePreference {
+	var prefs []languagePreference
+	for _, part := range strings.Split(header, ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if tag == "" {
+			continue
+		}
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			var err error
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		if q > 0 {
+			prefs = append(prefs, languagePreference{strings.ToLower(tag), q})
+		}
+	}
+	sort.SliceStable(prefs, func(i, j int) bool { return prefs[i].q > prefs[j].q })
+	return prefs
+}
+
+// negotiateLanguage picks the variant of path that best matches the
+// Accept-Language header, falling back to the default language. It reports
+// whether path has any variants at all, and must be called with s.mu held.
+func (s *server) negotiateLanguage(path, header string) (variant, lang string, varies bool) {
+	langs := s.variants[path]
+	if langs == nil {
+		return "", "", false
+	}
+	for _, pref := range parseAcceptLanguage(header) {
+		if v, ok := langs[pref.tag]; ok {
+			return v, pref.tag, true
+		}
+		primary, _, _ := strings.Cut(pref.tag, "-")
+		if v, ok := langs[primary]; ok {
+			return v, primary, true
+		}
+	}
+	if v, ok := langs[s.defaultLang]; ok {
+		return v, s.defaultLang, true
+	}
+	return "", "", true
+}
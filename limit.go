@@ -0,0 +1,131 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// limitConcurrency answers requests beyond s.maxRequests handled at once
+// with 503 right away, rather than letting them queue up. Status requests are
+// never turned away.
+func (s *server) limitConcurrency(next http.HandlerFunc) http.HandlerFunc {
+	if s.maxRequests == 0 {
+		return next
+	}
+	inFlight := make(chan struct{}, s.maxRequests)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/_/status" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		select {
+		case inFlight <- struct{}{}:
+			defer func() { <-inFlight }()
+			next.ServeHTTP(w, r)
+		default:
+			s.shedTotal.Add(1)
+			w.Header().Set("Retry-After", strconv.Itoa(int(s.shedRetryAfter.Seconds())))
+			http.Error(w, "too many requests in flight", http.StatusServiceUnavailable)
+		}
+	}
+}
+
+// limitPerClient answers requests from a client already having
+// s.maxPerClient requests in flight with 429.
+func (s *server) limitPerClient(next http.HandlerFunc) http.HandlerFunc {
+	if s.maxPerClient == 0 {
+		return next
+	}
+	var mu sync.Mutex
+	inFlight := make(map[string]int)
+	return func(w http.ResponseWriter, r *http.Request) {
+		ip := s.clientIP(r)
+		mu.Lock()
+		if inFlight[ip] >= s.maxPerClient {
+			mu.Unlock()
+			s.shedTotal.Add(1)
+			s.logViolation(r, "rate-limited")
+			w.Header().Set("Retry-After", strconv.Itoa(int(s.shedRetryAfter.Seconds())))
+			http.Error(w, "too many requests from this address", http.StatusTooManyRequests)
+			return
+		}
+		inFlight[ip]++
+		mu.Unlock()
+		defer func() {
+			mu.Lock()
+			if inFlight[ip]--; inFlight[ip] == 0 {
+				delete(inFlight, ip)
+			}
+			mu.Unlock()
+		}()
+		next.ServeHTTP(w, r)
+	}
+}
+
+// limitBandwidth paces responses so that together they send at most
+// s.maxBandwidth bytes a second.
+func (s *server) limitBandwidth(next http.HandlerFunc) http.HandlerFunc {
+	if s.maxBandwidth == 0 {
+		return next
+	}
+	l := &bandwidthLimiter{rate: float64(s.maxBandwidth)}
+	return func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(&throttledWriter{ResponseWriter: w, limiter: l, done: r.Context().Done()}, r)
+	}
+}
+
+type bandwidthLimiter struct {
+	mu   sync.Mutex
+	rate float64
+	next time.Time
+}
+
+// reserve returns how long to wait before sending n bytes, after the bytes
+// reserved before them.
+func (l *bandwidthLimiter) reserve(n int) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	wait := l.next.Sub(now)
+	l.next = l.next.Add(time.Duration(float64(n) / l.rate * float64(time.Second)))
+	return wait
+}
+
+// throttledWriter writes in chunks, each once the limiter allows it.
+type throttledWriter struct {
+	http.ResponseWriter
+	limiter *bandwidthLimiter
+	done    <-chan struct{}
+}
+
+func (w *throttledWriter) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		chunk := b[:min(len(b), 16<<10)]
+		if wait := w.limiter.reserve(len(chunk)); wait > 0 {
+			timer := time.NewTimer(wait)
+			select {
+			case <-timer.C:
+			case <-w.done:
+				timer.Stop()
+				return written, http.ErrAbortHandler
+			}
+		}
+		n, err := w.ResponseWriter.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		b = b[n:]
+	}
+	return written, nil
+}
+
+func (w *throttledWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
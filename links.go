@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"html"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+var linkAttr = regexp.MustCompile(`(?i)\s(?:href|src)\s*=\s*(?:"([^"]*)"|'([^']*)'|([^\s"'>]+))`)
+
+// brokenLink is an internal link of a cached HTML page to a path that isn't
+// cached.
+type brokenLink struct {
+	Page string `json:"page"`
+	Link string `json:"link"`
+}
+
+// indexLinks finds the broken internal links of the cached HTML pages with
+// -check-links, logging those newly broken. s.mu must be held.
+func (s *server) indexLinks() {
+	prev := make(map[brokenLink]bool, len(s.brokenLinks))
+	for _, l := range s.brokenLinks {
+		prev[l] = true
+	}
+	s.brokenLinks = s.brokenLinks[:0:0]
+	for relPath, entry := range s.cache.all() {
+		if !isHTML(relPath) || entry.file != "" {
+			continue
+		}
+		for _, m := range linkAttr.FindAllSubmatch(entry.content, -1) {
+			link := html.UnescapeString(string(m[1]) + string(m[2]) + string(m[3]))
+			target, ok := internalTarget(relPath, link)
+			if !ok || s.resolves(target) {
+				continue
+			}
+			l := brokenLink{Page: relPath, Link: link}
+			if !prev[l] {
+				warnf("broken link in %s to %s", relPath, link)
+			}
+			s.brokenLinks = append(s.brokenLinks, l)
+		}
+	}
+	sort.Slice(s.brokenLinks, func(i, j int) bool {
+		a, b := s.brokenLinks[i], s.brokenLinks[j]
+		return a.Page < b.Page || a.Page == b.Page && a.Link < b.Link
+	})
+}
+
+// internalTarget returns the path of the cache a link of the page at
+// relPath points to, if it's a link within the site.
+func internalTarget(relPath, link string) (string, bool) {
+	u, err := url.Parse(strings.TrimSpace(link))
+	if err != nil || u.Scheme != "" || u.Host != "" || u.Opaque != "" || u.Path == "" {
+		return "", false
+	}
+	p := u.Path
+	if !strings.HasPrefix(p, "/") {
+		p = path.Join("/", path.Dir(relPath), p)
+		if strings.HasSuffix(u.Path, "/") && p != "/" {
+			p += "/"
+		}
+	}
+	if strings.HasPrefix(p, "/_/") || strings.HasPrefix(p, "/_v/") {
+		return "", false
+	}
+	return p, true
+}
+
+// resolves reports whether a request for p would find a cached file, the
+// way handleRequest looks it up. s.mu must be held.
+func (s *server) resolves(p string) bool {
+	if p == "/" && s.file != "" {
+		p += s.file
+	} else if strings.HasSuffix(p, "/") {
+		p += "index.html"
+	}
+	relPath := norm.NFC.String(strings.TrimPrefix(p, "/"))
+	if s.cache.get(relPath) != nil || s.variants[relPath] != nil {
+		return true
+	}
+	_, folded := s.foldPath(relPath)
+	return folded
+}
+
+// handleLinks lists the broken internal links found by -check-links as JSON.
+func (s *server) handleLinks(w http.ResponseWriter, r *http.Request) {
+	s.mu.RLock()
+	links := s.brokenLinks
+	s.mu.RUnlock()
+	if links == nil {
+		links = []brokenLink{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(links)
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"log"
+)
+
+// logLevel is how severe a log line is. Lines below -log-level are left out.
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var minLevel = levelInfo
+
+func parseLogLevel(s string) (logLevel, error) {
+	switch s {
+	case "debug":
+		return levelDebug, nil
+	case "info":
+		return levelInfo, nil
+	case "warn":
+		return levelWarn, nil
+	case "error":
+		return levelError, nil
+	}
+	return 0, fmt.Errorf("invalid log level %q, want debug, info, warn or error", s)
+}
+
+// logAt logs a line at level, if -log-level lets it through.
+func logAt(level logLevel, format string, args ...any) {
+	if level < minLevel {
+		return
+	}
+	if otlp != nil {
+		otlp.export(level, fmt.Sprintf(format, args...))
+	}
+	if sink != nil {
+		emit(level, fmt.Sprintf(format, args...))
+		return
+	}
+	log.Printf(format, args...)
+}
+
+func debugf(format string, args ...any) { logAt(levelDebug, format, args...) }
+func infof(format string, args ...any)  { logAt(levelInfo, format, args...) }
+func warnf(format string, args ...any)  { logAt(levelWarn, format, args...) }
+func errorf(format string, args ...any) { logAt(levelError, format, args...) }
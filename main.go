@@ -2,44 +2,262 @@ package main
 
 import (
 	"bytes"
+	"cmp"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
 	"flag"
+	"fmt"
+	"hash/fnv"
+	"io/fs"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
 	"regexp"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"golang.org/x/text/unicode/norm"
 )
 
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listFlag) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
 type fileCache struct {
-	content []byte
-	modTime time.Time
+	content     []byte
+	modTime     time.Time
+	contentType string
+	version     string
+	hash        string
+	scripts     [][]byte
+	meta        *fileMeta
+	words       []string
+	size        int64
+	headers     entryHeaders
+	// gzipped is the content compressed under -compress, if it shrank.
+	gzipped []byte
+	// transformed is set if -transform changed the content, which its
+	// precompressed siblings then don't match.
+	transformed bool
+	// file is the path the content is read from on every request when it
+	// didn't fit under -max-memory, leaving content nil.
+	file string
+	// sourceModTime is the modification time the file had when it was read,
+	// compared by the next load, while modTime is kept from an earlier load
+	// as long as the content is unchanged.
+	sourceModTime time.Time
 }
 
 type server struct {
-	mu    sync.RWMutex
-	dir   string
-	cache map[string]*fileCache
+	mu          sync.RWMutex
+	dir         string
+	file        string
+	cache       *fileIndex
+	variants    map[string]map[string]string
+	sidecars    map[string]*fileMeta
+	dirs        map[string][]string
+	searchIndex map[string][]string
+
+	checksums        []byte
+	checksumsModTime time.Time
+	feedPath         string
+	feedTitle        string
+	feed             []byte
+	feedModTime      time.Time
+	changeHooks      []func(changeSet)
+	script           *script
+	transformers     []transformer
+	injections       []injection
+	canonicalURL     string
+	ogURL            bool
+	downloadCounts   *downloadCounts
+	folded           map[string]string
+	csp              string
+	defaultLang      string
+	typeRules        []contentTypeRule
+	validatorRules   []validatorRule
+
+	requestTimeout time.Duration
+	rangeTimeout   time.Duration
+	maxRequests    int
+	maxPerClient   int
+	maxBandwidth   int64
+	allowedHosts   []string
+
+	securityLog *log.Logger
+	sessionKeys [][]byte
+	sessionTTL  time.Duration
+	oidc        *oidcProvider
+	loginPaths  []*regexp.Regexp
+
+	forwardAuthURL     string
+	forwardAuthPaths   []*regexp.Regexp
+	forwardAuthHeaders []string
+
+	authRules   []authRule
+	basicUsers  map[string][]byte
+	jwtKeys     *jwks
+	jwtIssuer   string
+	jwtAudience string
+
+	geoDB    *geoDB
+	geoRules []geoRule
+
+	jsonErrorPrefixes []string
+
+	shadowURL     string
+	shadowPercent float64
+
+	canonicalHost   string
+	canonicalScheme string
+	trustedProxies  []*net.IPNet
+	shedRetryAfter  time.Duration
+	shedTotal       atomic.Int64
+
+	deployIDFile string
+	deployID     []byte
+	settle       time.Duration
+	// scanned is the signature of the names, sizes and modification times
+	// of the files found by the last walk, unchanged since scannedSince.
+	scanned      uint64
+	scannedSince time.Time
+	ready        atomic.Bool
+	refreshing   atomic.Bool
+	refreshStats refreshStats
+	lastChanges  changeSet
+	changeLog    []refreshDiff
+	events       eventHub
+	wsOrigins    []string
+	bytesRead    atomic.Int64
+	filesRead    atomic.Int64
+
+	maxMemory    int64
+	copyBuffers  sync.Pool
+	loadBytes    int64
+	loadOverflow int
+	cachedBytes  int64
+	overflowed   int
+	// loadContents holds the content of the load being built by hash, so
+	// identical files share it, and loadShared and sharedBytes count the
+	// bytes that saved.
+	loadContents map[string]*fileCache
+	loadShared   int64
+	sharedBytes  int64
+
+	// loadProblems are the files left out of the load being built, and
+	// problems those of the last load.
+	loadProblems []fileProblem
+	problems     []fileProblem
+
+	notFound      notFoundCache
+	notFoundTotal atomic.Int64
+	paths         atomic.Pointer[pathSet]
+
+	caseInsensitive bool
+	webdav          bool
+	publicFiles     bool
+	search          bool
+	checkLinks      bool
+	brokenLinks     []brokenLink
+	downloads       bool
+	serveChecksums  bool
+	followSymlinks  bool
+	symlinkRoots    []string
+	ignoreFile      string
+	only            []*regexp.Regexp
+	ignoreExts      map[string]bool
+	compress        bool
+	compressTypes   []string
+	maxFileSize     int64
+	skipped         int
+
+	archive        string
+	archiveModTime time.Time
+	fsys           fs.FS
+	backend        backend
+	syncFrom       string
+
+	version      int
+	keepVersions int
+	snapshots    []snapshot
+
+	variantDir     string
+	variantPercent float64
+
+	maintenance           atomic.Bool
+	maintenanceSentinel   atomic.Bool
+	maintenancePage       string
+	maintenanceRetryAfter time.Duration
 }
 
 func newServer(dir string) *server {
-	return &server{
+	s := &server{
 		dir:   dir,
-		cache: make(map[string]*fileCache),
+		cache: &fileIndex{},
+	}
+	if info, err := os.Stat(dir); err == nil && !info.IsDir() {
+		s.dir, s.file = filepath.Dir(dir), filepath.Base(dir)
 	}
+	return s
 }
 
-func (s *server) loadFiles(ignore regexp.Regexp) error {
-	seen := make(map[string]bool)
+// root returns the path to walk, which is the single served file if -dir
+// points at one.
+func (s *server) root() string {
+	if s.file != "" {
+		return filepath.Join(s.dir, s.file)
+	}
+	return s.dir
+}
 
-	if err := filepath.Walk(s.dir, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
+func (s *server) loadFiles(ignore regexp.Regexp) error {
+	if s.archive != "" {
+		return s.loadArchive(ignore)
+	}
+	if s.fsys != nil {
+		return s.loadFS(ignore)
+	}
+	if s.backend != nil {
+		return s.loadBackend(ignore)
+	}
+	if s.syncFrom != "" {
+		if err := s.syncDir(); err != nil {
 			return err
 		}
+	}
+	deployID, unchanged := s.checkDeployID()
+	if unchanged {
+		return nil
+	}
 
-		if info.IsDir() {
+	next := make(map[string]*fileCache)
+	ignores := make(ignoreFiles)
+	skipped := 0
+	scan := fnv.New64a()
+
+	if err := s.walk(func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if path == s.root() {
+				return err
+			}
+			s.skip(path, err)
+			skipped++
 			return nil
 		}
 
@@ -47,115 +265,1058 @@ func (s *server) loadFiles(ignore regexp.Regexp) error {
 		if err != nil {
 			return err
 		}
+		relPath = norm.NFC.String(filepath.ToSlash(relPath))
 
-		if ignore.MatchString(relPath) {
-			return nil
+		if info.IsDir() {
+			if relPath != "." && ignores.match(relPath, true) {
+				return filepath.SkipDir
+			}
+			return s.loadIgnoreFile(ignores, path, relPath)
 		}
 
-		seen[relPath] = true
+		if info.Name() == s.ignoreFile || ignores.match(relPath, false) {
+			return nil
+		}
+		if s.filtered(relPath, info, ignore) {
+			if s.oversized(relPath, info, ignore) {
+				skipped++
+			}
+			return nil
+		}
+		fmt.Fprintf(scan, "%s\x00%d %d\n", relPath, info.Size(), info.ModTime().UnixNano())
 
 		s.mu.RLock()
-		cached, exists := s.cache[relPath]
+		cached, exists := s.cache.lookup(relPath)
 		s.mu.RUnlock()
 
-		if exists && info.ModTime().Equal(cached.modTime) {
+		if exists && info.ModTime().Equal(cached.sourceModTime) {
+			s.loadBytes += int64(len(cached.content) + len(cached.gzipped))
+			s.share(cached, true)
+			next[relPath] = cached
 			return nil
 		}
 
-		log.Println("caching", relPath)
+		if s.processed(relPath) {
+			s.loadBytes += info.Size()
+		} else if !s.reserve(info.Size()) {
+			debugf("streaming %s", relPath)
+			entry, err := s.streamEntry(relPath, path, info.ModTime())
+			if err != nil {
+				s.skip(path, err)
+				skipped++
+				return nil
+			}
+			next[relPath] = keepModTime(entry, cached)
+			return nil
+		}
+		debugf("caching %s", relPath)
 		content, err := os.ReadFile(path)
 		if err != nil {
-			return err
-		}
-
-		s.mu.Lock()
-		s.cache[relPath] = &fileCache{
-			content: content,
-			modTime: info.ModTime(),
+			s.skip(path, err)
+			skipped++
+			return nil
 		}
-		s.mu.Unlock()
-
+		next[relPath] = keepModTime(s.newEntry(relPath, content, info.ModTime()), cached)
 		return nil
 	}); err != nil {
 		return err
 	}
 
+	if sig := scan.Sum64(); sig != s.scanned {
+		s.scanned, s.scannedSince = sig, time.Now()
+	}
+	if s.settle > 0 && s.loaded() && time.Since(s.scannedSince) < s.settle {
+		infof("files changed in the last %v, keeping the previous ones until they settle", s.settle)
+		return nil
+	}
+	s.swap(next, skipped)
+	s.deployID = deployID
+	return nil
+}
+
+// filtered reports whether a file is excluded by the ignore pattern or the
+// -only, -ignore-ext and -ignore-larger-than flags.
+func (s *server) filtered(relPath string, info os.FileInfo, ignore regexp.Regexp) bool {
+	return !s.included(relPath) || s.excluded(relPath, info) || ignore.MatchString(relPath)
+}
+
+func (s *server) newEntry(relPath string, content []byte, modTime time.Time) *fileCache {
+	s.bytesRead.Add(int64(len(content)))
+	s.filesRead.Add(1)
+	source := content
+	content, transformed := s.transform(relPath, content)
+	entry := &fileCache{
+		content:       content,
+		transformed:   !bytes.Equal(source, content),
+		modTime:       modTime,
+		sourceModTime: modTime,
+		contentType:   s.contentType(relPath, content),
+		hash:          contentHash(content),
+		meta:          contentMeta(relPath, content),
+		size:          int64(len(content)),
+	}
+
+	if ctype, ok := transformed["content-type"]; ok {
+		entry.contentType = ctype
+	}
+	s.share(entry, false)
+	if s.csp != "" && isHTML(relPath) {
+		entry.scripts = splitScripts(content)
+	}
+	if s.search && searchable(relPath) {
+		entry.words = searchWords(relPath, content)
+	}
+	s.compressEntry(relPath, entry)
+	entry.headers = s.entryHeaders(relPath, entry)
+	return entry
+}
+
+// keepModTime gives entry the modification time of the entry it replaces if
+// their content is the same, so a deploy rewriting identical files doesn't
+// change their Last-Modified and clients keep getting 304 Not Modified.
+func keepModTime(entry, prev *fileCache) *fileCache {
+	if prev != nil && prev.hash == entry.hash {
+		entry.modTime = prev.modTime
+		entry.headers.lastModified = prev.headers.lastModified
+	}
+	return entry
+}
+
+func contentHash(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+// swap atomically replaces the cache with the one built by a load, so that
+// requests never see a mix of old and new files, and rebuilds the indexes.
+func (s *server) swap(files map[string]*fileCache, skipped int) {
+	next := newFileIndex(files)
+	next.siblings = indexPrecompressed(next)
 	s.mu.Lock()
-	for path := range s.cache {
-		if !seen[path] {
-			log.Println("uncaching", path)
-			delete(s.cache, path)
-		}
+	first := s.version == 0
+	changes := diffCaches(s.cache, next)
+	for _, path := range changes.Removed {
+		debugf("uncaching %s", path)
+	}
+	s.recordVersion(next)
+	s.recordChanges(changes, s.cache, next)
+	s.cache = next
+	s.indexSidecars()
+	s.keepSidecars(next)
+	s.indexLanguages()
+	s.indexFolded()
+	if s.webdav {
+		s.indexDirs()
+	}
+	if s.search {
+		s.indexSearch()
+	}
+	if s.serveChecksums {
+		s.indexChecksums()
 	}
+	if s.feedPath != "" {
+		s.indexFeed()
+	}
+	if s.checkLinks {
+		s.indexLinks()
+	}
+	s.indexPaths()
+	s.skipped = skipped
+	s.problems = s.loadProblems
+	s.lastChanges = changes
+	s.cachedBytes, s.overflowed = s.loadBytes, s.loadOverflow
+	s.sharedBytes, s.loadContents = s.loadShared, nil
 	s.mu.Unlock()
+	s.notFound.clear()
+	s.logOverflow()
+	if first {
+		logProblems(s.loadProblems)
+	}
 
-	return nil
+	if !changes.empty() {
+		for _, fn := range s.changeHooks {
+			fn(changes)
+		}
+	}
+}
+
+func isHTML(path string) bool {
+	ext := strings.ToLower(filepath.Ext(path))
+	return ext == ".html" || ext == ".htm"
 }
 
 func logRequest(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		if minLevel > levelInfo {
+			next.ServeHTTP(w, r)
+			return
+		}
 		start := time.Now()
-		next.ServeHTTP(w, r)
-		log.Printf("%s %s %v", r.Method, r.URL.Path, time.Since(start))
+		dump := dumpHTTP(r)
+		if otlp == nil && !dump {
+			next.ServeHTTP(w, r)
+			logLine(r.Method, r.URL.Path, time.Since(start))
+			return
+		}
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r)
+		elapsed := time.Since(start)
+		logLine(r.Method, r.URL.Path, elapsed)
+		if dump {
+			logExchange(r, cmp.Or(sw.status, http.StatusOK), w.Header())
+		}
+		if otlp != nil {
+			otlp.exportRequest(r, cmp.Or(sw.status, http.StatusOK), sw.size, elapsed)
+		}
 	}
 }
 
 func (s *server) handleRequest(w http.ResponseWriter, r *http.Request) {
-	p := r.URL.Path
-	if strings.HasSuffix(p, "/") {
+	p, ok := canonicalPath(r.URL.Path)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if p != r.URL.Path {
+		u := url.URL{Path: p, RawQuery: r.URL.RawQuery}
+		http.Redirect(w, r, u.String(), http.StatusMovedPermanently)
+		return
+	}
+	if strings.HasPrefix(p, "/_v/") && s.keepVersions > 0 {
+		s.serveVersion(w, r, p)
+		return
+	}
+	if s.downloads && strings.HasSuffix(p, "/") {
+		if format := r.URL.Query().Get("download"); format != "" {
+			s.serveDownload(w, r, norm.NFC.String(strings.TrimPrefix(p, "/")), format)
+			return
+		}
+	}
+	if s.notFound.hit(p) {
+		s.notFoundTotal.Add(1)
+		http.NotFound(w, r)
+		return
+	}
+	requested := p
+	if p == "/" && s.file != "" {
+		p += s.file
+	} else if strings.HasSuffix(p, "/") {
 		p += "index.html"
 	}
-	path := strings.TrimPrefix(p, "/")
+	path := norm.NFC.String(strings.TrimPrefix(p, "/"))
 
+	if set := s.paths.Load(); !set.mayHave(path) {
+		if s.keepVersions > 0 {
+			w.Header().Set("X-Content-Version", strconv.Itoa(set.version))
+		}
+		s.notFoundTotal.Add(1)
+		http.NotFound(w, r)
+		return
+	}
 	s.mu.RLock()
-	cached, exists := s.cache[path]
+	if canonical, ok := s.foldPath(path); ok {
+		s.mu.RUnlock()
+		if strings.HasSuffix(p, "/") {
+			canonical = strings.TrimSuffix(canonical, "index.html")
+		}
+		u := url.URL{Path: "/" + canonical, RawQuery: r.URL.RawQuery}
+		http.Redirect(w, r, u.String(), http.StatusMovedPermanently)
+		return
+	}
+	// A miss isn't cached for a path whose variant B exists, as the other
+	// variant's visitors get a file for it.
+	var abVaries bool
+	if s.variantDir != "" {
+		if b := s.variantDir + "/" + path; s.cache.get(b) != nil || s.variants[b] != nil {
+			abVaries = true
+			if s.inVariantB(w, r) {
+				path = b
+			}
+		}
+	}
+	variant, lang, varies := s.negotiateLanguage(path, r.Header.Get("Accept-Language"))
+	if variant != "" {
+		path = variant
+	}
+	cached, exists := s.cache.lookup(path)
+	pre := s.cache.siblings[path]
+	var redirect string
+	var meta fileMeta
+	if exists {
+		var hidden bool
+		hidden, redirect = s.hidden(path, cached)
+		exists = !hidden
+		meta = s.meta(path, cached)
+	}
+	version := s.version
 	s.mu.RUnlock()
 
+	if redirect != "" {
+		http.Redirect(w, r, redirect, http.StatusFound)
+		return
+	}
+	if !s.authorizeFile(w, r, path) {
+		return
+	}
+
+	if s.keepVersions > 0 {
+		w.Header().Set("X-Content-Version", strconv.Itoa(version))
+	}
+	if varies {
+		varyOn(w.Header(), "Accept-Language")
+	}
+	if lang != "" {
+		w.Header().Set("Content-Language", lang)
+	}
+
 	if !exists {
+		if !varies && !abVaries {
+			s.notFound.add(requested)
+		}
+		s.notFoundTotal.Add(1)
 		http.NotFound(w, r)
 		return
 	}
 
-	http.ServeContent(w, r, path, cached.modTime, bytes.NewReader(cached.content))
+	if s.serveMeta(w, r, meta) {
+		return
+	}
+	s.downloadCounts.count(r, path)
+	s.serveEntry(w, r, path, cached, pre)
+}
+
+func (s *server) serveEntry(w http.ResponseWriter, r *http.Request, path string, cached *fileCache, pre precompressed) {
+	if pre.br != nil || pre.gzip != nil {
+		varyOn(w.Header(), "Accept-Encoding")
+		if coding, sibling := pre.pick(r); sibling != nil && r.Header.Get("Range") == "" {
+			s.serveSibling(w, r, path, coding, cached, sibling)
+			return
+		}
+	}
+	etag := cached.headers.etag
+	var gw *gzipWriter
+	// Ranges are served of the identity content. Cached files that weren't
+	// gzipped when cached didn't shrink enough to be worth it.
+	if s.compressible(path, cached.headers.contentType[0]) {
+		varyOn(w.Header(), "Accept-Encoding")
+		gzipOK := accepts(r, "gzip") && r.Header.Get("Range") == ""
+		if gzipOK && cached.gzipped != nil {
+			s.serveGzipped(w, r, path, cached)
+			return
+		}
+		if gzipOK && (cached.file != "" && cached.size >= 256 || cached.scripts != nil) {
+			gw = &gzipWriter{ResponseWriter: w}
+			defer gw.Close()
+			w, etag = gw, gzipETag(etag)
+			w.Header().Set("Content-Encoding", "gzip")
+		}
+	}
+	if gw == nil && cached.scripts == nil && s.servePlain(w, r, cached) {
+		return
+	}
+	w.Header()["Content-Type"] = cached.headers.contentType
+	if etag != nil {
+		w.Header()["Etag"] = etag
+	}
+	// http.ServeContent neither sends nor checks Last-Modified for a zero time.
+	modTime := cached.modTime
+	if cached.headers.lastModified == nil {
+		modTime = time.Time{}
+	}
+
+	if cached.file != "" {
+		f, err := cached.open()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer f.Close()
+		http.ServeContent(w, r, path, modTime, f)
+		return
+	}
+
+	content := cached.content
+	if cached.scripts != nil {
+		nonce := newNonce()
+		w.Header().Set("Content-Security-Policy", cspHeader(s.csp, nonce))
+		content = stampNonce(cached.scripts, nonce)
+	}
+
+	serveBytes(w, r, path, modTime, content)
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "bench" {
+		benchMain(os.Args[2:])
+		return
+	}
+	// fastserve check takes the flags of serving, loading the files and
+	// checking them rather than serving them.
+	check := len(os.Args) > 1 && os.Args[1] == "check"
+	if check {
+		os.Args = append(os.Args[:1], os.Args[2:]...)
+	}
+
 	addr := flag.String("addr", ":8080", "address to listen on")
 	dir := flag.String("dir", ".", "directory to serve")
+	syncFrom := flag.String("sync-from", "", "rsync source or http(s) manifest URL to update -dir from before each refresh")
+	archive := flag.String("archive", "", "zip or tar archive to serve instead of -dir")
+	s3URI := flag.String("s3", "", "s3://bucket/prefix to serve instead of -dir")
+	s3Region := flag.String("s3-region", "us-east-1", "S3 region")
+	s3Endpoint := flag.String("s3-endpoint", "", "S3-compatible endpoint URL, such as a MinIO server")
+	gcsURI := flag.String("gcs", "", "gs://bucket/prefix to serve instead of -dir")
+	gcsCredentials := flag.String("gcs-credentials", "", "Google Cloud service account key file, defaults to $GOOGLE_APPLICATION_CREDENTIALS")
+	azureURI := flag.String("azure", "", "azure://account/container/prefix to serve instead of -dir")
+	gitURL := flag.String("git", "", "git repository URL to serve a branch of instead of -dir")
+	gitBranch := flag.String("git-branch", "main", "git branch to serve")
+	gitDir := flag.String("git-dir", "", "directory to keep the bare git clone in, defaults to a temporary directory")
+	manifestURL := flag.String("manifest", "", "URL of a JSON manifest of remote files to mirror instead of -dir")
 	refresh := flag.Duration("refresh", time.Minute, "file refresh interval")
+	refreshJitter := flag.Duration("refresh-jitter", 0, "maximum random delay added to each refresh interval")
+	watch := flag.Bool("watch", false, "also refresh as soon as files change, watching directories with inotify and polling those it can't watch, as on NFS or FUSE, every -watch-poll")
+	watchPoll := flag.Duration("watch-poll", 2*time.Second, "how often -watch polls the directories it can't watch")
+	variantDir := flag.String("variant-b", "", "subdirectory holding variant B of files for A/B tests")
+	variantPercent := flag.Float64("variant-b-percent", 50, "percentage of visitors routed to variant B")
+	publicURL := flag.String("public-url", "", "public base URL the site is served at, such as https://example.com")
+	purgeProvider := flag.String("purge", "", "CDN to purge changed URLs from after a refresh: cloudflare or fastly")
+	purgeZone := flag.String("purge-zone", "", "Cloudflare zone ID to purge")
+	warmURL := flag.String("warm-url", "", "CDN or public base URL, such as https://example.com, to request changed files from after a refresh so edge caches hold them, after purging with -purge")
+	warmConcurrency := flag.Int("warm-concurrency", 4, "requests in flight at once warming -warm-url")
+	var webhooks listFlag
+	flag.Var(&webhooks, "webhook", "URL to POST the paths added, modified and removed by every refresh to as JSON, signed with $FASTSERVE_WEBHOOK_SECRET, may be repeated")
+	publishTo := flag.String("publish", "", "s3://bucket/prefix or http(s) origin URL to upload changed files to after a refresh")
+	adminAddr := flag.String("admin-addr", "", "address to serve the admin endpoints on, empty to disable")
+	adminGRPC := flag.Bool("admin-grpc", false, "also serve the gRPC control service of control.proto on -admin-addr")
+	maintenanceFile := flag.String("maintenance-file", "", "sentinel file switching maintenance mode on while it exists")
+	maintenancePage := flag.String("maintenance-page", "maintenance.html", "cached file served during maintenance")
+	maintenanceRetryAfter := flag.Duration("maintenance-retry-after", 5*time.Minute, "Retry-After sent during maintenance")
+	notFoundTTL := flag.Duration("404-cache-ttl", 10*time.Second, "how long to remember missed paths, 0 to disable")
+	notFoundSize := flag.Int64("404-cache-size", 10000, "maximum number of missed paths to remember")
+	keepVersions := flag.Int("keep-versions", 0, "number of past refreshes to keep serving under /_v/<version>/")
 	ignorePattern := flag.String("ignore", "^\\.", "file ignore pattern")
+	ignoreFile := flag.String("ignore-file", ".fastserveignore", "name of gitignore-style ignore files, empty to disable")
+	var only listFlag
+	flag.Var(&only, "only", "comma-separated glob patterns of the only files to serve, may be repeated")
+	ignoreExts := flag.String("ignore-ext", "", "comma-separated file extensions to ignore")
+	compress := flag.Bool("compress", false, "gzip responses of -compress-types for clients that accept it, cached files when they're cached")
+	compressTypes := flag.String("compress-types", defaultCompressTypes, "comma-separated media types, type/* prefixes and extensions such as .map to compress, never already compressed formats such as jpg, png, woff2, zip and mp4")
+	ignoreLargerThan := flag.String("ignore-larger-than", "", "ignore files larger than this size, such as 50MB")
+	maxMemory := flag.String("max-memory", "", "cache at most this much file content, such as 512MB, serving further files from disk")
+	copyBuffer := flag.String("copy-buffer", "32KB", "buffer size for streaming files from disk where sendfile can't be used, as over TLS")
+	goMemLimit := flag.String("gomemlimit", "", "soft memory limit the garbage collector works to stay under, such as 2GB, empty to use $GOMEMLIMIT")
+	goGC := flag.Int("gogc", 0, "garbage collection target percentage, -1 to collect only near -gomemlimit, 0 to use $GOGC")
 	timeout := flag.Duration("timeout", 30*time.Second, "HTTP timeout")
+	readHeaderTimeout := flag.Duration("read-header-timeout", 10*time.Second, "time allowed to read request headers")
+	idleTimeout := flag.Duration("idle-timeout", 2*time.Minute, "how long to keep idle connections open")
+	maxHeaderBytes := flag.Int("max-header-bytes", http.DefaultMaxHeaderBytes, "maximum size of request headers")
+	requestTimeout := flag.Duration("request-timeout", 0, "time allowed to handle a request and write the response, 0 for no limit")
+	rangeTimeout := flag.Duration("range-timeout", 0, "request timeout for range requests, 0 to use -request-timeout")
+	maxRequests := flag.Int("max-requests", 0, "maximum number of requests handled at once, 0 for no limit")
+	maxPerClient := flag.Int("max-per-client", 0, "maximum number of requests handled at once for one client address, 0 for no limit")
+	maxBandwidth := flag.String("max-bandwidth", "", "maximum bytes a second sent in responses to all clients together, such as 10MB, empty for no limit")
+	shedRetryAfter := flag.Duration("shed-retry-after", time.Second, "Retry-After sent to requests beyond -max-requests or -max-per-client")
+	var trustedProxies listFlag
+	flag.Var(&trustedProxies, "trusted-proxy", "address or CIDR range of a proxy whose X-Forwarded-For is trusted, may be repeated")
+	tlsCert := flag.String("tls-cert", "", "certificate file to serve HTTPS with")
+	tlsKey := flag.String("tls-key", "", "private key file for -tls-cert")
+	tlsMinVersion := flag.String("tls-min-version", "1.2", "minimum TLS version: 1.0, 1.1, 1.2 or 1.3")
+	tlsCiphers := flag.String("tls-ciphers", "", "comma-separated TLS 1.2 cipher suites, empty for Go's defaults")
+	tlsCurves := flag.String("tls-curves", "", "comma-separated key exchange curves in order of preference, empty for Go's defaults")
+	ocspStaple := flag.Bool("ocsp-staple", false, "staple OCSP responses from the certificate issuer's responder")
+	keepAlive := flag.Bool("keep-alive", true, "keep connections open between requests")
+	csp := flag.String("csp", "", "Content-Security-Policy for HTML files, {nonce} is replaced with a per-response nonce")
+	defaultLang := flag.String("default-lang", "en", "language served when Accept-Language matches no variant")
+	mimeTypes := flag.String("mime-types", "", "mime.types file extending the built-in MIME types")
+	caseInsensitive := flag.Bool("case-insensitive", false, "redirect paths differing only in case to the cached file")
+	followSymlinks := flag.Bool("follow-symlinks", false, "follow symlinks that resolve inside the served directory")
+	var symlinkRoots listFlag
+	flag.Var(&symlinkRoots, "symlink-root", "directory outside -dir that symlinks may resolve into, may be repeated")
+	webdav := flag.Bool("webdav", false, "answer WebDAV PROPFIND requests so the tree can be mounted read-only")
+	publicFiles := flag.Bool("public-files", false, "serve the /_/files listing, /_/changes, /_/events, /_/ws, /_/links and /_/problems publicly, not just on -admin-addr")
+	wsOrigins := flag.String("ws-origin", "", "comma-separated origins, such as https://dash.example.com, allowed to open /_/ws from a browser, empty for the same host")
+	search := flag.Bool("search", false, "index text documents and serve full-text search at /_/search?q=")
+	checkLinks := flag.Bool("check-links", false, "log internal links of HTML files to paths that aren't cached, and list them at /_/links")
+	downloads := flag.Bool("downloads", false, "serve directories as archives at /dir/?download=zip|tar|tgz")
+	serveChecksums := flag.Bool("checksums", false, "serve the sha256 and size of every file at /_/manifest")
+	allowedHosts := flag.String("allowed-hosts", "", "comma-separated hosts to answer requests for, *.example.com matching subdomains, empty for any")
+	canonicalHost := flag.String("canonical-host", "", "host, with the port if not the default, to redirect requests for other hosts to")
+	canonicalScheme := flag.String("canonical-scheme", "", "scheme, http or https, to redirect requests made with the other to")
+	geoIPDB := flag.String("geoip-db", "", "MaxMind country or city database for -geo-rule")
+	var geoRules listFlag
+	flag.Var(&geoRules, "geo-rule", "pattern=allow:CC,... or pattern=deny:CC,... restricting matching paths by client country, may be repeated")
+	securityLog := flag.String("security-log", "", "file to log failed authentication and rate limit violations to for fail2ban")
+	oidcIssuer := flag.String("oidc-issuer", "", "OpenID Connect issuer to log in with for -login-path, client secret in OIDC_CLIENT_SECRET")
+	oidcClientID := flag.String("oidc-client-id", "", "OpenID Connect client ID")
+	oidcRedirectURL := flag.String("oidc-redirect-url", "", "OpenID Connect redirect URL, such as https://example.com/_/oidc/callback")
+	var loginPaths listFlag
+	flag.Var(&loginPaths, "login-path", "comma-separated patterns of paths requiring login, may be repeated")
+	sessionTTL := flag.Duration("session-ttl", 8*time.Hour, "how long a session lasts after authenticating, signed with the comma-separated FASTSERVE_SESSION_KEYS")
+	forwardAuthURL := flag.String("forward-auth", "", "URL asked whether to serve each request, as with nginx's auth_request")
+	var forwardAuthPaths listFlag
+	flag.Var(&forwardAuthPaths, "forward-auth-path", "comma-separated patterns of paths checked with -forward-auth, may be repeated, all paths if none")
+	forwardAuthHeaders := flag.String("forward-auth-headers", "", "comma-separated headers copied from -forward-auth answers into the request")
+	var authRules listFlag
+	flag.Var(&authRules, "auth", "pattern=public|basic|login|jwt[:claim=value] authentication required for matching paths, may be repeated")
+	basicAuthFile := flag.String("basic-auth-file", "", "file of user:bcrypt-hash lines for basic authentication")
+	jwtJWKS := flag.String("jwt-jwks", "", "JSON Web Key Set URL verifying jwt authentication")
+	jwtIssuer := flag.String("jwt-issuer", "", "issuer required of jwt authentication tokens")
+	jwtAudience := flag.String("jwt-audience", "", "audience required of jwt authentication tokens, such as this server's client ID with the issuer")
+	shadowURL := flag.String("shadow", "", "URL to mirror requests to in the background, such as a new origin being validated")
+	shadowPercent := flag.Float64("shadow-percent", 100, "percentage of requests to mirror to -shadow")
+	jsonErrorPrefixes := flag.String("json-errors", "", "comma-separated path prefixes, such as /api/, to answer errors under as JSON")
+	middlewareOrder := flag.String("middleware", strings.Join(defaultMiddleware, ","), "comma-separated built-in middleware in the order requests pass through them")
+	scriptFile := flag.String("script", "", "Starlark script defining on_request(req) and on_refresh(path, content) hooks")
+	transforms := flag.String("transform", "script,inject,canonical", "comma-separated transforms applied to files as they're cached, in order: script, inject, canonical, minify-css")
+	canonicalURL := flag.String("canonical-url", "", "base URL, such as https://example.com, of the canonical links added to HTML files lacking one")
+	ogURL := flag.Bool("og-url", false, "also add og:url meta tags pointing under -canonical-url")
+	feedPath := flag.String("feed", "", "path, such as /feed.xml, to serve an RSS feed of the markdown files with a title and date in their metadata at")
+	feedTitle := flag.String("feed-title", "", "title of the -feed, defaulting to -canonical-url")
+	var injections listFlag
+	flag.Var(&injections, "inject", "position=file snippet inserted into HTML files at head-start, head-end, body-start or body-end, may be repeated")
+	var countDownloads listFlag
+	flag.Var(&countDownloads, "count-downloads", "comma-separated patterns of files to count downloads of at /admin/downloads, may be repeated")
+	downloadCountsFile := flag.String("download-counts", "", "file the download counts are saved to and resumed from")
+	bindEarly := flag.Bool("bind-early", false, "listen before the initial load is done, answering 503 until it is")
+	deployIDFile := flag.String("deploy-id", "", "file in -dir changed by every deploy, such as .deploy-id, to skip walking -dir while it's unchanged")
+	settle := flag.Duration("settle", 0, "keep serving the previous files until the names, sizes and modification times of the files in -dir have stayed the same for this long, as during a deploy")
+	failOnEmpty := flag.Bool("fail-on-empty", false, "exit if the initial load caches no files, as with a wrong -dir")
+	var siteSpecs listFlag
+	flag.Var(&siteSpecs, "site", "host=dir[,cert,key] serving dir, with its own certificate if given, for requests to host, may be repeated")
+	logLevelName := flag.String("log-level", "info", "least severe log lines written: debug for every cached file, info for requests too, warn or error")
+	quiet := flag.Bool("quiet", false, "log errors only, as with -log-level error")
+	logOutput := flag.String("log-output", "stderr", "where to log: stderr, syslog or journald")
+	otlpEndpoint := flag.String("otlp-endpoint", "", "OTLP/HTTP collector, such as http://collector:4318, to export log lines and requests to, with the resource attributes of OTEL_RESOURCE_ATTRIBUTES and OTEL_SERVICE_NAME")
+	syslogAddr := flag.String("syslog-addr", "", "syslog server for -log-output syslog, such as udp://logs:514 or tcp://logs:601, empty for /dev/log")
+	configFile := flag.String("config", "", "JSON file of further sites, each with its own dir, host or listener, certificate and flag overrides, reloaded when it changes or on SIGHUP")
+	var contentTypes listFlag
+	flag.Var(&contentTypes, "content-type", "pattern=type Content-Type override, may be repeated")
+	serveTest := flag.Bool("serve-test", false, "with fastserve check, request every cached file through the handler and report those failing")
+	var debugPaths listFlag
+	flag.Var(&debugPaths, "debug-http", "comma-separated patterns of paths whose request and response headers are logged, may be repeated")
+	debugSample := flag.Float64("debug-http-sample", 1, "fraction of the requests matching -debug-http logged, between 0 and 1")
+	var validatorRules listFlag
+	flag.Var(&validatorRules, "validators", "pattern=etag|weak-etag|last-modified|none,... validators sent and honored for matching paths, may be repeated, etag,last-modified by default")
 	flag.Parse()
 
+	level, err := parseLogLevel(*logLevelName)
+	if err != nil {
+		log.Fatal(err)
+	}
+	minLevel = level
+	if *quiet {
+		minLevel = levelError
+	}
+	s, err := newLogSink(*logOutput, *syslogAddr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	useSink(s)
+	if debugHTTP.paths, err = parseGlobs(debugPaths); err != nil {
+		log.Fatal(err)
+	}
+	debugHTTP.sample = *debugSample
+	if *otlpEndpoint != "" {
+		otlp = newOTLPExporter(*otlpEndpoint)
+	}
+
+	if err := tuneGC(*goMemLimit, *goGC); err != nil {
+		log.Fatal(err)
+	}
+
 	ignore, err := regexp.Compile(*ignorePattern)
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	if *mimeTypes != "" {
+		if err := loadMimeTypes(*mimeTypes); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// The first key signs new sessions; the others are still accepted, so
+	// that keys can be rotated without logging everyone out.
+	var sessionKeys [][]byte
+	for _, key := range splitList(os.Getenv("FASTSERVE_SESSION_KEYS")) {
+		sessionKeys = append(sessionKeys, []byte(key))
+	}
+	if len(sessionKeys) == 0 {
+		sessionKeys = [][]byte{[]byte(newNonce())}
+	}
+	// Sites configured with the same databases and logs share them.
+	geoDBs := make(map[string]*geoDB)
+	securityLogs := make(map[string]*log.Logger)
+
+	// configure applies the flags to the server for -dir and for every -site,
+	// with the overrides of a -config site in effect while it's called for it.
+	configure := func(s *server) error {
+		var err error
+		s.keepVersions = *keepVersions
+		s.requestTimeout = *requestTimeout
+		s.rangeTimeout = *rangeTimeout
+		s.maxRequests = *maxRequests
+		s.maxPerClient = *maxPerClient
+		if *maxBandwidth != "" {
+			if s.maxBandwidth, err = parseSize(*maxBandwidth); err != nil {
+				return err
+			}
+		}
+		if s.trustedProxies, err = parseProxies(trustedProxies); err != nil {
+			return err
+		}
+		s.shedRetryAfter = *shedRetryAfter
+		s.notFound.ttl = *notFoundTTL
+		s.notFound.maxSize = *notFoundSize
+		s.variantDir = strings.Trim(*variantDir, "/")
+		s.variantPercent = *variantPercent
+		s.maintenancePage = strings.TrimPrefix(*maintenancePage, "/")
+		s.maintenanceRetryAfter = *maintenanceRetryAfter
+		s.csp = *csp
+		s.defaultLang = strings.ToLower(*defaultLang)
+		s.caseInsensitive = *caseInsensitive
+		s.webdav = *webdav
+		s.publicFiles = *publicFiles
+		s.wsOrigins = splitList(*wsOrigins)
+		s.search = *search
+		s.checkLinks = *checkLinks
+		s.downloads = *downloads
+		s.serveChecksums = *serveChecksums
+		s.ignoreFile = *ignoreFile
+		if s.only, err = parseGlobs(only); err != nil {
+			return err
+		}
+		s.ignoreExts = make(map[string]bool)
+		for _, ext := range strings.Split(*ignoreExts, ",") {
+			if ext = strings.TrimSpace(ext); ext != "" {
+				s.ignoreExts["."+strings.ToLower(strings.TrimPrefix(ext, "."))] = true
+			}
+		}
+		s.compress = *compress
+		s.compressTypes = nil
+		for _, t := range splitList(*compressTypes) {
+			s.compressTypes = append(s.compressTypes, strings.ToLower(t))
+		}
+		if *ignoreLargerThan != "" {
+			if s.maxFileSize, err = parseSize(*ignoreLargerThan); err != nil {
+				return err
+			}
+		}
+		if *maxMemory != "" {
+			if s.maxMemory, err = parseSize(*maxMemory); err != nil {
+				return err
+			}
+		}
+		bufSize, err := parseSize(*copyBuffer)
+		if err != nil || bufSize == 0 {
+			return fmt.Errorf("invalid -copy-buffer %q", *copyBuffer)
+		}
+		s.copyBuffers.New = func() any { b := make([]byte, bufSize); return &b }
+		s.deployIDFile = *deployIDFile
+		s.settle = *settle
+		s.followSymlinks = *followSymlinks
+		s.symlinkRoots = symlinkRoots
+		if s.typeRules, err = parseContentTypeRules(contentTypes); err != nil {
+			return err
+		}
+		if s.validatorRules, err = parseValidatorRules(validatorRules); err != nil {
+			return err
+		}
+
+		s.script = nil
+		if *scriptFile != "" {
+			if s.script, err = loadScript(*scriptFile); err != nil {
+				return err
+			}
+		}
+		if s.injections, err = parseInjections(injections); err != nil {
+			return err
+		}
+		s.canonicalURL = strings.TrimSuffix(*canonicalURL, "/")
+		s.ogURL = *ogURL
+		s.feedPath = ""
+		if *feedPath != "" {
+			s.feedPath = "/" + strings.TrimPrefix(*feedPath, "/")
+		}
+		s.feedTitle = *feedTitle
+		s.transformers = nil
+		for _, name := range splitList(*transforms) {
+			t, err := s.builtinTransformer(name)
+			if err != nil {
+				return err
+			}
+			s.transformers = append(s.transformers, t)
+		}
+		s.geoDB = nil
+		if *geoIPDB != "" {
+			if s.geoDB = geoDBs[*geoIPDB]; s.geoDB == nil {
+				if s.geoDB, err = openGeoDB(*geoIPDB); err != nil {
+					return err
+				}
+				geoDBs[*geoIPDB] = s.geoDB
+				go s.geoDB.watch()
+			}
+		}
+		if s.geoRules, err = parseGeoRules(geoRules); err != nil {
+			return err
+		}
+		s.securityLog = nil
+		if *securityLog != "" {
+			if s.securityLog = securityLogs[*securityLog]; s.securityLog == nil {
+				if s.securityLog, err = openSecurityLog(*securityLog); err != nil {
+					return err
+				}
+				securityLogs[*securityLog] = s.securityLog
+			}
+		}
+		s.sessionKeys = siteSessionKeys(sessionKeys, s.dir)
+		s.sessionTTL = *sessionTTL
+		s.oidc = nil
+		if *oidcIssuer != "" {
+			if s.oidc, err = newOIDCProvider(*oidcIssuer, *oidcClientID, *oidcRedirectURL); err != nil {
+				return err
+			}
+		}
+		if s.loginPaths, err = parseGlobs(loginPaths); err != nil {
+			return err
+		}
+		s.forwardAuthURL = *forwardAuthURL
+		if s.forwardAuthPaths, err = parseGlobs(forwardAuthPaths); err != nil {
+			return err
+		}
+		s.forwardAuthHeaders = splitList(*forwardAuthHeaders)
+		s.basicUsers = nil
+		if *basicAuthFile != "" {
+			if s.basicUsers, err = loadBasicUsers(*basicAuthFile); err != nil {
+				return err
+			}
+		}
+		s.jwtKeys = &jwks{url: *jwtJWKS}
+		s.jwtIssuer = *jwtIssuer
+		s.jwtAudience = *jwtAudience
+		if s.authRules, err = parseAuthRules(authRules); err != nil {
+			return err
+		}
+		for _, rule := range s.authRules {
+			if err := s.checkMechanism(rule); err != nil {
+				return err
+			}
+		}
+		if s.jwtAudience == "" && slices.ContainsFunc(s.authRules, func(rule authRule) bool { return rule.mechanism == "jwt" }) {
+			warnf("accepting jwt tokens issued for any audience, set -jwt-audience")
+		}
+		s.shadowURL = *shadowURL
+		s.shadowPercent = *shadowPercent
+		s.jsonErrorPrefixes = splitList(*jsonErrorPrefixes)
+		s.canonicalHost = strings.ToLower(*canonicalHost)
+		s.canonicalScheme = strings.ToLower(*canonicalScheme)
+		s.allowedHosts = nil
+		for _, host := range splitList(*allowedHosts) {
+			s.allowedHosts = append(s.allowedHosts, strings.ToLower(host))
+		}
+		return nil
+	}
+
 	srv := newServer(*dir)
+	// A binary built with its files embedded serves them unless it's given
+	// a source.
+	useEmbedded := embedded != nil && *syncFrom == ""
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "dir" {
+			useEmbedded = false
+		}
+	})
+	for _, s := range []string{*archive, *s3URI, *gcsURI, *azureURI, *gitURL, *manifestURL} {
+		if s != "" {
+			useEmbedded = false
+		}
+	}
+	if useEmbedded {
+		srv = newFSServer(embedded)
+	}
+	if err := configure(srv); err != nil {
+		log.Fatal(err)
+	}
+	srv.archive = *archive
+	srv.syncFrom = *syncFrom
+	if len(countDownloads) > 0 {
+		patterns, err := parseGlobs(countDownloads)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if srv.downloadCounts, err = newDownloadCounts(patterns, *downloadCountsFile); err != nil {
+			log.Fatal(err)
+		}
+		if *downloadCountsFile != "" {
+			go srv.downloadCounts.saveEveryMinute()
+		}
+	}
+	switch {
+	case *s3URI != "":
+		srv.backend, err = newS3Client(*s3URI, *s3Region, *s3Endpoint)
+	case *gcsURI != "":
+		srv.backend, err = newGCSClient(*gcsURI, *gcsCredentials)
+	case *azureURI != "":
+		srv.backend, err = newAzureClient(*azureURI)
+	case *gitURL != "":
+		srv.backend, err = newGitClient(*gitURL, *gitBranch, *gitDir)
+	case *manifestURL != "":
+		srv.backend, err = newManifestClient(*manifestURL)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	// loadSite loads the files of a site, for it to be served.
+	loadSite := func(srv *server, ignore regexp.Regexp) error {
+		if err := srv.refresh(ignore); err != nil {
+			return err
+		}
+		srv.mu.RLock()
+		empty := srv.cache.len() == 0
+		srv.mu.RUnlock()
+		if *failOnEmpty && empty {
+			return fmt.Errorf("no files cached from %s", srv.dir)
+		}
+		return nil
+	}
+	// runSite marks a loaded site ready and refreshes it until it's stopped.
+	runSite := func(st *site) {
+		st.srv.ready.Store(true)
+		go refreshEvery([]*server{st.srv}, st.ignore, st.refresh, st.refreshJitter, st.stop)
+		if st.watch {
+			go watchDir(st.srv, st.ignore, st.watchPoll, st.stop)
+		}
+		if st.certs != nil {
+			go st.certs.watch(st.stop)
+		}
+		if st.maintenanceFile != "" {
+			go st.srv.watchMaintenanceFile(st.maintenanceFile, st.stop)
+		}
+	}
 
-	if err := srv.loadFiles(*ignore); err != nil {
+	// The main server's chain is built before the sites are prepared, as
+	// each site's own middleware wraps what the main server's does.
+	sites := new(siteList)
+	handler, err := srv.chain(*middlewareOrder, sites, siteHandler(srv, sites))
+	if err != nil {
 		log.Fatal(err)
 	}
+	handler = srv.maintenanceMode(sites, handler.ServeHTTP)
+
+	var static []site
+	for _, spec := range siteSpecs {
+		st, err := parseSite(spec)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if st.certFile != "" && *tlsCert == "" {
+			log.Fatal("-site certificates require -tls-cert")
+		}
+		st.srv = newServer(st.dir)
+		if err := configure(st.srv); err != nil {
+			log.Fatal(err)
+		}
+		st.ignore, st.refresh, st.refreshJitter = *ignore, *refresh, *refreshJitter
+		st.watch, st.watchPoll, st.maintenanceFile = *watch, *watchPoll, *maintenanceFile
+		if st.certFile != "" {
+			if st.certs, err = newCertLoader(st.certFile, st.keyFile, *ocspStaple); err != nil {
+				log.Fatal(err)
+			}
+		}
+		if err := st.prepare(*middlewareOrder, sites); err != nil {
+			log.Fatal(err)
+		}
+		static = append(static, st)
+	}
+	sites.store(static)
+
+	reloader := &configReloader{
+		path:   *configFile,
+		sites:  sites,
+		static: static,
+		run:    runSite,
+		newTLS: func() (*tls.Config, error) { return tlsConfig(*tlsMinVersion, *tlsCiphers, *tlsCurves) },
+	}
+	reloader.build = func(sc siteConfig) (*site, error) {
+		st := &site{host: strings.ToLower(sc.Host), dir: sc.Dir, certFile: sc.Cert, keyFile: sc.Key, addr: sc.Addr, stop: make(chan struct{})}
+		if st.certFile != "" && st.addr == "" && *tlsCert == "" {
+			return nil, errors.New("certificates of sites without an addr require -tls-cert")
+		}
+		st.srv = newServer(st.dir)
+		st.srv.maintenance.Store(srv.maintenance.Load())
+		err := withFlags(sc.Flags, func() error {
+			if err := configure(st.srv); err != nil {
+				return err
+			}
+			pattern, err := regexp.Compile(*ignorePattern)
+			if err != nil {
+				return err
+			}
+			st.ignore, st.refresh, st.refreshJitter = *pattern, *refresh, *refreshJitter
+			st.watch, st.watchPoll, st.maintenanceFile = *watch, *watchPoll, *maintenanceFile
+			return st.prepare(*middlewareOrder, sites)
+		})
+		if err != nil {
+			return nil, err
+		}
+		if st.certFile != "" {
+			if st.certs, err = newCertLoader(st.certFile, st.keyFile, *ocspStaple); err != nil {
+				return nil, err
+			}
+		}
+		return st, loadSite(st.srv, st.ignore)
+	}
+
+	var hooks []func(changeSet)
+	var purger *cdnPurger
+	if *purgeProvider != "" {
+		if purger, err = newCDNPurger(*purgeProvider, *publicURL, *purgeZone); err != nil {
+			log.Fatal(err)
+		}
+	}
+	var warmer *cdnWarmer
+	if *warmURL != "" {
+		warmer = newCDNWarmer(*warmURL, *warmConcurrency)
+	}
+	// Warming before the purge is done would fill the cache with what's
+	// about to be purged.
+	if purger != nil || warmer != nil {
+		hooks = append(hooks, func(c changeSet) {
+			// Only what an anonymous client could get is warmed, while a
+			// purge drops whatever the CDN may hold.
+			public := srv.publicChanges(c)
+			go func() {
+				if purger != nil {
+					purger.purge(c)
+				}
+				if warmer != nil {
+					warmer.warm(public)
+				}
+			}()
+		})
+	}
 
-	go func() {
-		for {
-			time.Sleep(*refresh)
-			start := time.Now()
-			if err := srv.loadFiles(*ignore); err != nil {
+	if len(webhooks) > 0 {
+		var targets []*webhook
+		for _, u := range webhooks {
+			targets = append(targets, newWebhook(u))
+		}
+		hooks = append(hooks, srv.webhookChanges(targets))
+	}
+
+	if *publishTo != "" {
+		pub, err := newPublisher(*publishTo, *s3Region, *s3Endpoint)
+		if err != nil {
+			log.Fatal(err)
+		}
+		hooks = append(hooks, srv.publishChanges(pub))
+	}
+
+	// start loads the files and only then registers the change hooks, so
+	// that the initial load isn't purged or published as a change, and
+	// refreshes them from then on.
+	start := func() {
+		if err := loadSite(srv, *ignore); err != nil {
+			log.Fatal(err)
+		}
+		for _, st := range static {
+			if err := loadSite(st.srv, st.ignore); err != nil {
 				log.Fatal(err)
 			}
-			log.Println("refreshed in", time.Since(start))
 		}
-	}()
+		if *configFile != "" {
+			if err := reloader.load(); err != nil {
+				log.Fatal(err)
+			}
+			go reloader.watch()
+		}
+		for _, fn := range hooks {
+			srv.onChange(fn)
+		}
+		srv.ready.Store(true)
+		go refreshEvery([]*server{srv}, *ignore, *refresh, *refreshJitter, nil)
+		if *watch {
+			go watchDir(srv, *ignore, *watchPoll, nil)
+		}
+		for i := range static {
+			runSite(&static[i])
+		}
+	}
 
 	server := &http.Server{
-		Addr:         *addr,
-		Handler:      logRequest(srv.handleRequest),
-		ReadTimeout:  *timeout,
-		WriteTimeout: *timeout,
+		Addr:              *addr,
+		Handler:           logRequest(handler.ServeHTTP),
+		ReadTimeout:       *timeout,
+		ReadHeaderTimeout: *readHeaderTimeout,
+		WriteTimeout:      *timeout,
+		IdleTimeout:       *idleTimeout,
+		MaxHeaderBytes:    *maxHeaderBytes,
+
+		DisableGeneralOptionsHandler: true,
+	}
+	server.SetKeepAlivesEnabled(*keepAlive)
+	if *tlsCert != "" {
+		if server.TLSConfig, err = tlsConfig(*tlsMinVersion, *tlsCiphers, *tlsCurves); err != nil {
+			log.Fatal(err)
+		}
+		certs, err := newCertLoader(*tlsCert, *tlsKey, *ocspStaple)
+		if err != nil {
+			log.Fatal(err)
+		}
+		server.TLSConfig.GetCertificate = siteCertificate(certs, sites)
+		go certs.watch(nil)
+	}
+	reloader.base = server
+	if *bindEarly && !check {
+		go start()
+	} else {
+		start()
+	}
+	if check {
+		os.Exit(runCheck(srv, handler, *serveTest))
 	}
 
-	log.Printf("serving %s on %s", *dir, *addr)
+	if *maintenanceFile != "" {
+		go srv.watchMaintenanceFile(*maintenanceFile, nil)
+	}
+
+	if *adminAddr != "" {
+		admin := &http.Server{Addr: *adminAddr, Handler: logRequest(srv.adminHandler(sites).ServeHTTP)}
+		if *adminGRPC {
+			// gRPC needs HTTP/2, spoken in cleartext on the admin port.
+			grpcServer := newControlServer(&control{srv, *ignore, purger})
+			handler := admin.Handler
+			admin.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.ProtoMajor == 2 && strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+					grpcServer.ServeHTTP(w, r)
+					return
+				}
+				handler.ServeHTTP(w, r)
+			})
+			admin.Protocols = new(http.Protocols)
+			admin.Protocols.SetHTTP1(true)
+			admin.Protocols.SetUnencryptedHTTP2(true)
+		}
+		go func() {
+			infof("serving admin endpoints on %s", *adminAddr)
+			log.Fatal(admin.ListenAndServe())
+		}()
+	}
+
+	source := *dir
+	if srv.fsys != nil {
+		source = "embedded files"
+	}
+	for _, s := range []string{*archive, *s3URI, *gcsURI, *azureURI, *gitURL, *manifestURL} {
+		if s != "" {
+			source = s
+		}
+	}
+	infof("serving %s on %s", source, *addr)
+	for _, st := range static {
+		infof("serving %s for %s", st.dir, st.host)
+	}
+	if *tlsCert != "" {
+		log.Fatal(server.ListenAndServeTLS("", ""))
+	}
 	log.Fatal(server.ListenAndServe())
 }
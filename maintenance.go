@@ -0,0 +1,94 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// inMaintenance reports whether maintenance mode was switched on through the
+// admin endpoint or by creating the sentinel file.
+func (s *server) inMaintenance() bool {
+	return s.maintenance.Load() || s.maintenanceSentinel.Load()
+}
+
+// watchMaintenanceFile polls for the maintenance sentinel file until stop
+// is closed.
+func (s *server) watchMaintenanceFile(name string, stop <-chan struct{}) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		_, err := os.Stat(name)
+		s.maintenanceSentinel.Store(err == nil)
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// maintenanceMode answers every request with 503 and the maintenance page
+// while maintenance mode is on, for the server of the site a request is
+// for, or s for any other host. It wraps the middleware, so that protected
+// paths are answered 503 too rather than asking for credentials.
+func (s *server) maintenanceMode(sites *siteList, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		srv := s
+		if st := sites.lookup(requestHost(r)); st != nil {
+			srv = st.srv
+		}
+		if !srv.inMaintenance() || r.URL.Path == "/_/status" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Set("Retry-After", strconv.Itoa(int(srv.maintenanceRetryAfter.Seconds())))
+		w.Header().Set("Cache-Control", "no-store")
+		srv.mu.RLock()
+		page := srv.cache.get(srv.maintenancePage)
+		srv.mu.RUnlock()
+		if page == nil {
+			http.Error(w, "down for maintenance", http.StatusServiceUnavailable)
+			return
+		}
+		ctype := page.contentType
+		if ctype == "" {
+			ctype = "text/html; charset=utf-8"
+		}
+		w.Header().Set("Content-Type", ctype)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		if r.Method != http.MethodHead {
+			copyEntry(w, page)
+		}
+	}
+}
+
+// handleMaintenance switches maintenance mode on or off, as given in the
+// request body, for s and every site.
+func (s *server) handleMaintenance(sites *siteList) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(io.LimitReader(r.Body, 16))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var on bool
+		switch strings.TrimSpace(string(body)) {
+		case "on":
+			on = true
+		case "off":
+		default:
+			http.Error(w, "body must be on or off", http.StatusBadRequest)
+			return
+		}
+		s.maintenance.Store(on)
+		for _, st := range sites.load() {
+			st.srv.maintenance.Store(on)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
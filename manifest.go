@@ -0,0 +1,112 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// manifestClient mirrors the remote files listed by a JSON manifest of
+// {"url", "path", "sha256"} entries, refetching a file only when its hash
+// in the manifest changes.
+type manifestClient struct {
+	url string
+
+	mu      sync.Mutex
+	entries map[string]manifestEntry
+}
+
+type manifestEntry struct {
+	URL    string `json:"url"`
+	Path   string `json:"path"`
+	SHA256 string `json:"sha256"`
+}
+
+func newManifestClient(manifestURL string) (*manifestClient, error) {
+	if _, err := url.Parse(manifestURL); err != nil {
+		return nil, err
+	}
+	return &manifestClient{url: manifestURL}, nil
+}
+
+func (c *manifestClient) list(fn func(object) error) error {
+	body, err := httpGet(c.url)
+	if err != nil {
+		return err
+	}
+	var entries []manifestEntry
+	if err := json.Unmarshal(body, &entries); err != nil {
+		return fmt.Errorf("%s: %w", c.url, err)
+	}
+
+	base, _ := url.Parse(c.url)
+	byPath := make(map[string]manifestEntry)
+	for _, entry := range entries {
+		ref, err := url.Parse(entry.URL)
+		if err != nil {
+			return fmt.Errorf("%s: %w", c.url, err)
+		}
+		entry.URL = base.ResolveReference(ref).String()
+		entry.Path = strings.TrimPrefix(entry.Path, "/")
+		entry.SHA256 = strings.ToLower(entry.SHA256)
+		byPath[entry.Path] = entry
+	}
+	c.mu.Lock()
+	c.entries = byPath
+	c.mu.Unlock()
+
+	for path, entry := range byPath {
+		version := entry.SHA256
+		if version == "" {
+			version = entry.URL
+		}
+		// The manifest gives no sizes.
+		if err := fn(object{key: path, path: path, version: version, size: -1}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// get fetches the file at a path and checks it against its hash in the
+// manifest.
+func (c *manifestClient) get(key string) ([]byte, error) {
+	c.mu.Lock()
+	entry := c.entries[key]
+	c.mu.Unlock()
+	content, err := httpGet(entry.URL)
+	if err != nil {
+		return nil, err
+	}
+	if entry.SHA256 != "" {
+		sum := sha256.Sum256(content)
+		if got := hex.EncodeToString(sum[:]); got != entry.SHA256 {
+			return nil, fmt.Errorf("%s: sha256 %s doesn't match manifest %s", entry.URL, got, entry.SHA256)
+		}
+	}
+	return content, nil
+}
+
+// fetchClient fetches the files and manifests content is loaded from, with
+// a timeout so that an origin that hangs fails a refresh instead of
+// stalling it.
+var fetchClient = &http.Client{Timeout: 5 * time.Minute}
+
+func httpGet(u string) ([]byte, error) {
+	resp, err := fetchClient.Get(u)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: %s", u, resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"time"
+)
+
+// reserve reports whether n more bytes of content fit under -max-memory in
+// the load being built, counting them if so. Files that don't fit are
+// counted as overflowed instead.
+func (s *server) reserve(n int64) bool {
+	if s.maxMemory > 0 && s.loadBytes+n > s.maxMemory {
+		s.loadOverflow++
+		return false
+	}
+	s.loadBytes += n
+	return true
+}
+
+// share points entry at the content already held for the same hash in the
+// load being built, if any, so identical files are kept in memory once. An
+// entry reused from the last load is read by requests and isn't changed,
+// only not counted twice if it already shares the content.
+func (s *server) share(entry *fileCache, reused bool) {
+	if len(entry.content) == 0 || s.loadContents == nil {
+		return
+	}
+	held, ok := s.loadContents[entry.hash]
+	if !ok {
+		s.loadContents[entry.hash] = entry
+		return
+	}
+	n := int64(len(held.content))
+	if reused {
+		if &held.content[0] != &entry.content[0] {
+			return
+		}
+		if len(entry.gzipped) > 0 && len(held.gzipped) > 0 && &held.gzipped[0] == &entry.gzipped[0] {
+			n += int64(len(held.gzipped))
+		}
+	} else {
+		entry.content = held.content
+	}
+	s.loadBytes -= n
+	s.loadShared += n
+}
+
+// streamEntry returns an entry for a file on disk that doesn't fit under
+// -max-memory, served from the file on every request instead of memory.
+func (s *server) streamEntry(relPath, path string, modTime time.Time) (*fileCache, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	head := make([]byte, 512)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, err
+	}
+	head = head[:n]
+	h := sha256.New()
+	h.Write(head)
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return nil, err
+	}
+	s.bytesRead.Add(int64(n) + size)
+	s.filesRead.Add(1)
+	entry := &fileCache{
+		modTime:       modTime,
+		sourceModTime: modTime,
+		contentType:   s.contentType(relPath, head),
+		hash:          hex.EncodeToString(h.Sum(nil)),
+		size:          int64(n) + size,
+		file:          path,
+	}
+	if entry.contentType == "" {
+		entry.contentType = mimeType(relPath, head)
+	}
+	entry.headers = s.entryHeaders(relPath, entry)
+	return entry, nil
+}
+
+// open returns a reader over the entry's content, from the file on disk if
+// it wasn't cached.
+func (e *fileCache) open() (io.ReadSeekCloser, error) {
+	if e.file == "" {
+		return nopCloser{bytes.NewReader(e.content)}, nil
+	}
+	return os.Open(e.file)
+}
+
+// bytes returns the entry's content, reading it from disk if it wasn't
+// cached.
+func (e *fileCache) bytes() ([]byte, error) {
+	if e.file == "" {
+		return e.content, nil
+	}
+	return os.ReadFile(e.file)
+}
+
+type nopCloser struct{ *bytes.Reader }
+
+func (nopCloser) Close() error { return nil }
+
+// logOverflow warns when the last load had files left out of memory.
+func (s *server) logOverflow() {
+	if s.loadOverflow > 0 {
+		warnf("not caching %d files beyond -max-memory of %d bytes", s.loadOverflow, s.maxMemory)
+	}
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const metaSuffix = ".meta"
+
+// fileMeta is per-file metadata, read from a front matter block at the top
+// of the file or from a sidecar file named after it with a .meta suffix.
+type fileMeta struct {
+	publishAt time.Time
+	expiresAt time.Time
+	// expiredRedirect is where to redirect to once the file has expired,
+	// instead of responding 404.
+	expiredRedirect string
+	// redirect is where to redirect to instead of serving the file, with
+	// redirectStatus, 301 unless given.
+	redirect       string
+	redirectStatus int
+	cacheControl   string
+	headers        map[string]string
+	// auth is required to serve the file, in addition to any -auth rule.
+	auth *authRule
+	// invalid is set for metadata that doesn't parse or names an auth
+	// mechanism that isn't configured, hiding the file rather than serving
+	// it without the auth it may have asked for.
+	invalid bool
+	// err is why front matter doesn't parse, reported as it's indexed.
+	err error
+	// title, date and summary describe a post in the -feed.
+	title   string
+	date    time.Time
+	summary string
+}
+
+// parseMeta parses metadata given either as a JSON object or as key: value
+// lines. Besides publish_at, expires_at and expired_redirect, it may set
+// redirect and redirect_status, cache_control, auth as in -auth, response
+// headers as header.Name keys or a JSON headers object, and the title, date
+// and summary of a post.
+func parseMeta(data []byte) (*fileMeta, error) {
+	fields := make(map[string]string)
+	if data = bytes.TrimSpace(data); bytes.HasPrefix(data, []byte("{")) {
+		var obj map[string]any
+		if err := json.Unmarshal(data, &obj); err != nil {
+			return nil, err
+		}
+		for k, v := range obj {
+			if headers, ok := v.(map[string]any); ok && k == "headers" {
+				for name, value := range headers {
+					fields["header."+name] = fmt.Sprint(value)
+				}
+				continue
+			}
+			fields[k] = fmt.Sprint(v)
+		}
+	} else {
+		scanner := bufio.NewScanner(bytes.NewReader(data))
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			k, v, ok := strings.Cut(line, ":")
+			if !ok {
+				return nil, fmt.Errorf("invalid metadata line %q", line)
+			}
+			fields[strings.TrimSpace(k)] = strings.Trim(strings.TrimSpace(v), `"'`)
+		}
+	}
+
+	m := new(fileMeta)
+	for k, v := range fields {
+		var err error
+		switch k {
+		case "publish_at":
+			m.publishAt, err = parseMetaTime(v)
+		case "expires_at":
+			m.expiresAt, err = parseMetaTime(v)
+		case "expired_redirect":
+			m.expiredRedirect = v
+		case "redirect":
+			m.redirect = v
+		case "redirect_status":
+			m.redirectStatus, err = strconv.Atoi(v)
+			if err == nil && (m.redirectStatus < 300 || m.redirectStatus > 399) {
+				err = fmt.Errorf("invalid redirect status %d", m.redirectStatus)
+			}
+		case "title":
+			m.title = v
+		case "date":
+			m.date, err = parseMetaTime(v)
+		case "summary":
+			m.summary = v
+		case "cache_control":
+			m.cacheControl = v
+		case "auth":
+			var rule authRule
+			if rule, err = parseAuthMechanism(v); err == nil {
+				m.auth = &rule
+			}
+		default:
+			if name, ok := strings.CutPrefix(k, "header."); ok {
+				if m.headers == nil {
+					m.headers = make(map[string]string)
+				}
+				m.headers[name] = v
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", k, err)
+		}
+	}
+	return m, nil
+}
+
+func parseMetaTime(v string) (time.Time, error) {
+	for _, layout := range []string{time.RFC3339, "2006-01-02 15:04:05", "2006-01-02 15:04", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, v, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q", v)
+}
+
+// frontMatter returns the metadata block at the top of content, delimited
+// by --- lines as in markdown or by an HTML comment.
+func frontMatter(content []byte) ([]byte, bool) {
+	content = bytes.TrimLeft(content, " \t\r\n")
+	for _, delims := range [][2]string{{"---\n", "\n---"}, {"<!--", "-->"}} {
+		if rest, ok := bytes.CutPrefix(content, []byte(delims[0])); ok {
+			block, _, ok := bytes.Cut(rest, []byte(delims[1]))
+			return block, ok
+		}
+	}
+	return nil, false
+}
+
+// contentMeta parses the front matter of a markdown or HTML file, if any.
+// Front matter that doesn't parse is invalid, so that none of what it may
+// have asked for, such as publish_at or auth, is dropped silently.
+func contentMeta(relPath string, content []byte) *fileMeta {
+	if !isHTML(relPath) && !strings.HasSuffix(strings.ToLower(relPath), ".md") {
+		return nil
+	}
+	block, ok := frontMatter(content)
+	if !ok || !bytes.Contains(block, []byte(":")) {
+		return nil
+	}
+	m, err := parseMeta(block)
+	if err != nil {
+		return &fileMeta{invalid: true, err: err}
+	}
+	return m
+}
+
+// indexSidecars parses the .meta sidecar files of cached files, and hides
+// the files whose metadata is invalid. It must be called with s.mu held.
+func (s *server) indexSidecars() {
+	s.sidecars = make(map[string]*fileMeta)
+	for path, entry := range s.cache.all() {
+		if m := entry.meta; m != nil {
+			err := m.err
+			if err == nil && m.auth != nil {
+				if err = s.checkMechanism(*m.auth); err != nil {
+					m.invalid = true
+				}
+			}
+			if err != nil {
+				warnf("hiding %s, invalid front matter: %v", path, err)
+				s.addProblem(path, "invalid-metadata", err.Error())
+			}
+		}
+		target, ok := strings.CutSuffix(path, metaSuffix)
+		if !ok || s.cache.get(target) == nil {
+			continue
+		}
+		m, err := parseMeta(entry.content)
+		if err == nil && m.auth != nil {
+			err = s.checkMechanism(*m.auth)
+		}
+		if err != nil {
+			warnf("hiding %s, invalid metadata %s: %v", target, path, err)
+			s.addProblem(path, "invalid-metadata", err.Error())
+			m = &fileMeta{invalid: true}
+		}
+		s.sidecars[target] = m
+	}
+}
+
+// fileView is a cache and the sidecars indexed for it, which the metadata
+// of its files is looked up in: the current one, or a snapshot kept for
+// /_v/.
+type fileView struct {
+	cache    *fileIndex
+	sidecars map[string]*fileMeta
+}
+
+// view returns the current cache. It must be called with s.mu held, as must
+// the methods of what it returns.
+func (s *server) view() fileView {
+	return fileView{s.cache, s.sidecars}
+}
+
+func (s *server) siblingBase(path string) (string, *fileCache, bool) {
+	return s.view().siblingBase(path)
+}
+
+func (s *server) meta(path string, entry *fileCache) fileMeta {
+	return s.view().meta(path, entry)
+}
+
+func (s *server) hidden(path string, entry *fileCache) (bool, string) {
+	return s.view().hidden(path, entry)
+}
+
+// siblingBase returns the cached file path is a compressed copy of, such as
+// post.html for post.html.gz, whose metadata and auth the copy shares, as it
+// holds the same content.
+func (v fileView) siblingBase(path string) (string, *fileCache, bool) {
+	for _, ext := range []string{".br", ".gz"} {
+		if base, ok := strings.CutSuffix(path, ext); ok {
+			if entry := v.cache.get(base); entry != nil {
+				return base, entry, true
+			}
+		}
+	}
+	return "", nil, false
+}
+
+// meta returns the metadata of a cached file, with its sidecar taking
+// precedence over its front matter.
+func (v fileView) meta(path string, entry *fileCache) fileMeta {
+	if base, baseEntry, ok := v.siblingBase(path); ok {
+		return v.meta(base, baseEntry)
+	}
+	var m fileMeta
+	if entry.meta != nil {
+		m = *entry.meta
+	}
+	if sidecar := v.sidecars[path]; sidecar != nil {
+		if !sidecar.publishAt.IsZero() {
+			m.publishAt = sidecar.publishAt
+		}
+		if !sidecar.expiresAt.IsZero() {
+			m.expiresAt = sidecar.expiresAt
+		}
+		if sidecar.expiredRedirect != "" {
+			m.expiredRedirect = sidecar.expiredRedirect
+		}
+		if sidecar.redirect != "" {
+			m.redirect, m.redirectStatus = sidecar.redirect, sidecar.redirectStatus
+		}
+		if sidecar.title != "" {
+			m.title = sidecar.title
+		}
+		if !sidecar.date.IsZero() {
+			m.date = sidecar.date
+		}
+		if sidecar.summary != "" {
+			m.summary = sidecar.summary
+		}
+		if sidecar.cacheControl != "" {
+			m.cacheControl = sidecar.cacheControl
+		}
+		if sidecar.auth != nil {
+			m.auth = sidecar.auth
+		}
+		m.invalid = m.invalid || sidecar.invalid
+		if sidecar.headers != nil {
+			headers := make(map[string]string)
+			for name, value := range m.headers {
+				headers[name] = value
+			}
+			for name, value := range sidecar.headers {
+				headers[name] = value
+			}
+			m.headers = headers
+		}
+	}
+	return m
+}
+
+// serveMeta applies the redirect, auth and headers set in the metadata of
+// the file being served, reporting whether the request was answered.
+func (s *server) serveMeta(w http.ResponseWriter, r *http.Request, m fileMeta) bool {
+	if m.redirect != "" {
+		status := m.redirectStatus
+		if status == 0 {
+			status = http.StatusMovedPermanently
+		}
+		http.Redirect(w, r, m.redirect, status)
+		return true
+	}
+	if m.auth != nil && m.auth.mechanism != "public" {
+		w.Header().Set("Cache-Control", "private")
+		if !s.authenticate(w, r, *m.auth) {
+			return true
+		}
+	}
+	// A file requiring auth stays private whatever its metadata says.
+	if m.cacheControl != "" && w.Header().Get("Cache-Control") != "private" {
+		w.Header().Set("Cache-Control", m.cacheControl)
+	}
+	for name, value := range m.headers {
+		w.Header().Set(name, value)
+	}
+	return false
+}
+
+// hidden reports whether a cached file must not be served right now, either
+// because it is a sidecar, its metadata is invalid, it isn't published yet
+// or has expired. For expired files it also returns where to redirect to, if
+// anywhere.
+func (v fileView) hidden(path string, entry *fileCache) (bool, string) {
+	if target, ok := strings.CutSuffix(path, metaSuffix); ok && v.sidecars[target] != nil {
+		return true, ""
+	}
+	m := v.meta(path, entry)
+	now := time.Now()
+	if m.invalid || m.publishAt.After(now) {
+		return true, ""
+	}
+	if !m.expiresAt.IsZero() && !m.expiresAt.After(now) {
+		return true, m.expiredRedirect
+	}
+	return false, ""
+}
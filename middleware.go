@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// middleware wraps a handler with a concern such as authentication.
+type middleware func(http.Handler) http.Handler
+
+// defaultMiddleware is the order the built-in middleware wrap requests in,
+// outermost first.
+var defaultMiddleware = []string{
+	"json-errors", "ready", "shadow", "hosts", "canonical", "max-requests", "max-per-client",
+	"max-bandwidth", "timeout", "geo", "script", "login", "forward-auth", "auth",
+}
+
+// siteMiddleware are the built-in middleware configured per site. A
+// request for the host of a site passes through the site's own in their
+// place in the order, rather than those of the main server.
+var siteMiddleware = map[string]bool{
+	"json-errors": true, "shadow": true, "timeout": true, "geo": true, "script": true,
+	"login": true, "forward-auth": true, "auth": true,
+}
+
+// builtinMiddleware returns the built-in middleware with the given name,
+// handing requests for the hosts of sites to their own middleware for those
+// configured per site.
+func (s *server) builtinMiddleware(name string, sites *siteList) (middleware, error) {
+	var wrap func(http.HandlerFunc) http.HandlerFunc
+	switch name {
+	case "json-errors":
+		wrap = s.jsonErrors
+	case "ready":
+		wrap = s.awaitReady
+	case "shadow":
+		wrap = s.shadowRequests
+	case "hosts":
+		wrap = func(next http.HandlerFunc) http.HandlerFunc { return s.checkHost(sites, next) }
+	case "canonical":
+		wrap = func(next http.HandlerFunc) http.HandlerFunc { return s.redirectCanonical(sites, next) }
+	case "max-requests":
+		wrap = s.limitConcurrency
+	case "max-per-client":
+		wrap = s.limitPerClient
+	case "max-bandwidth":
+		wrap = s.limitBandwidth
+	case "timeout":
+		wrap = s.limitTime
+	case "geo":
+		wrap = s.restrictGeo
+	case "script":
+		wrap = s.runScript
+	case "login":
+		wrap = s.requireLogin
+	case "forward-auth":
+		wrap = s.forwardAuth
+	case "auth":
+		wrap = s.authorize
+	default:
+		return nil, fmt.Errorf("unknown middleware %q, want one of %s", name, strings.Join(defaultMiddleware, ", "))
+	}
+	if !siteMiddleware[name] || sites == nil {
+		return func(next http.Handler) http.Handler { return wrap(next.ServeHTTP) }, nil
+	}
+	return func(next http.Handler) http.Handler {
+		sites.setInner(name, next)
+		own := wrap(next.ServeHTTP)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if st := sites.lookup(requestHost(r)); st != nil {
+				st.layers[name].ServeHTTP(w, r)
+				return
+			}
+			own(w, r)
+		})
+	}, nil
+}
+
+// configuredMiddleware reports, for each built-in middleware, whether the
+// flags of s give it anything to do.
+func (s *server) configuredMiddleware() map[string]bool {
+	return map[string]bool{
+		"json-errors":    len(s.jsonErrorPrefixes) > 0,
+		"shadow":         s.shadowURL != "",
+		"hosts":          len(s.allowedHosts) > 0,
+		"canonical":      s.canonicalHost != "" || s.canonicalScheme != "",
+		"max-requests":   s.maxRequests != 0,
+		"max-per-client": s.maxPerClient != 0,
+		"max-bandwidth":  s.maxBandwidth != 0,
+		"timeout":        s.requestTimeout != 0 || s.rangeTimeout != 0,
+		"geo":            s.geoDB != nil && len(s.geoRules) > 0,
+		"script":         s.script != nil && s.script.onRequest != nil,
+		"login":          s.oidc != nil,
+		"forward-auth":   s.forwardAuthURL != "",
+		"auth":           len(s.authRules) > 0,
+	}
+}
+
+// checkMiddleware fails for a built-in middleware s is configured to use
+// that isn't in names, as its flags would silently have no effect.
+func (s *server) checkMiddleware(names []string) error {
+	configured := s.configuredMiddleware()
+	for _, name := range defaultMiddleware {
+		if configured[name] && !slices.Contains(names, name) {
+			return fmt.Errorf("-middleware leaves out %s, which the flags given use", name)
+		}
+	}
+	return nil
+}
+
+// chain returns h wrapped in the built-in middleware named in the
+// comma-separated order, outermost first.
+func (s *server) chain(order string, sites *siteList, h http.Handler) (http.Handler, error) {
+	names := splitList(order)
+	if err := s.checkMiddleware(names); err != nil {
+		return nil, err
+	}
+	for i := len(names) - 1; i >= 0; i-- {
+		mw, err := s.builtinMiddleware(names[i], sites)
+		if err != nil {
+			return nil, err
+		}
+		h = mw(h)
+	}
+	return h, nil
+}
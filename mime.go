@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"mime"
+	"os"
+	"strings"
+)
+
+// loadMimeTypes registers the extensions listed in an nginx-style mime.types
+// file, or a file of ext=type lines, overriding Go's built-in table.
+func loadMimeTypes(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var statements []string
+	var nginx strings.Builder
+	for _, line := range strings.Split(string(data), "\n") {
+		line, _, _ = strings.Cut(line, "#")
+		if ext, typ, ok := strings.Cut(line, "="); ok {
+			statements = append(statements, typ+" "+ext)
+			continue
+		}
+		nginx.WriteString(line + "\n")
+	}
+	body := nginx.String()
+	if _, inner, ok := strings.Cut(body, "{"); ok {
+		body, _, _ = strings.Cut(inner, "}")
+	}
+	statements = append(statements, strings.Split(body, ";")...)
+
+	for _, statement := range statements {
+		fields := strings.Fields(statement)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) == 1 {
+			return fmt.Errorf("%s: no extensions for %s", path, fields[0])
+		}
+		for _, ext := range fields[1:] {
+			if err := mime.AddExtensionType("."+strings.TrimPrefix(ext, "."), fields[0]); err != nil {
+				return fmt.Errorf("%s: %w", path, err)
+			}
+		}
+	}
+	return nil
+}
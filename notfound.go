@@ -0,0 +1,94 @@
+package main
+
+import (
+	"hash/maphash"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// notFoundCache remembers recently missed paths for a short time, so that
+// scanners probing many nonexistent URLs are answered without the cache
+// lookup. It is cleared whenever the cache changes.
+type notFoundCache struct {
+	ttl     time.Duration
+	maxSize int64
+
+	paths sync.Map // path -> expiry time.Time
+	size  atomic.Int64
+}
+
+func (c *notFoundCache) hit(path string) bool {
+	if c.ttl == 0 {
+		return false
+	}
+	expiry, ok := c.paths.Load(path)
+	return ok && time.Now().Before(expiry.(time.Time))
+}
+
+func (c *notFoundCache) add(path string) {
+	if c.ttl == 0 {
+		return
+	}
+	if c.size.Add(1) > c.maxSize {
+		c.clear()
+	}
+	c.paths.Store(path, time.Now().Add(c.ttl))
+}
+
+func (c *notFoundCache) clear() {
+	c.paths.Clear()
+	c.size.Store(0)
+}
+
+// pathSet holds the hashes of every path a request could be served from,
+// sorted, so that handleRequest can answer most misses without taking the
+// lock or allocating. A hash collision only sends a miss the slow way.
+type pathSet struct {
+	seed    maphash.Seed
+	hashes  []uint64
+	version int
+	folded  bool
+}
+
+// indexPaths builds the pathSet of the cache. It must be called with s.mu
+// held, after the other indexes.
+func (s *server) indexPaths() {
+	set := &pathSet{seed: maphash.MakeSeed(), version: s.version, folded: s.folded != nil}
+	set.hashes = make([]uint64, 0, s.cache.len()+len(s.variants))
+	add := func(p string) {
+		set.hashes = append(set.hashes, set.hash(p))
+		// A request for p is served from the variant B of p.
+		if rest, ok := strings.CutPrefix(p, s.variantDir+"/"); ok && s.variantDir != "" {
+			set.hashes = append(set.hashes, set.hash(rest))
+		}
+	}
+	for p := range s.cache.all() {
+		add(p)
+	}
+	for p := range s.variants {
+		add(p)
+	}
+	slices.Sort(set.hashes)
+	set.hashes = slices.Compact(set.hashes)
+	s.paths.Store(set)
+}
+
+func (set *pathSet) hash(p string) uint64 {
+	if set.folded {
+		p = strings.ToLower(p)
+	}
+	return maphash.String(set.seed, p)
+}
+
+// mayHave reports whether p could be in the cache. It is true before the
+// first load.
+func (set *pathSet) mayHave(p string) bool {
+	if set == nil {
+		return true
+	}
+	_, found := slices.BinarySearch(set.hashes, set.hash(p))
+	return found
+}
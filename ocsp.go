@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// staple fetches an OCSP response for cert from its issuer's responder and
+// staples it to cert, recording when it's due to be refreshed: halfway to the
+// response's next update, or in an hour if that isn't given or fetching
+// failed. A previous staple is kept on failure until it expires.
+func (c *certLoader) staple(cert *tls.Certificate) error {
+	c.nextStaple = time.Now().Add(time.Hour)
+	raw, resp, err := fetchOCSP(cert)
+	if err != nil {
+		if time.Now().After(c.stapleExpiry) {
+			cert.OCSPStaple = nil
+		}
+		return err
+	}
+	if resp.Status != ocsp.Good {
+		cert.OCSPStaple = nil
+		return fmt.Errorf("certificate status is %d", resp.Status)
+	}
+
+	cert.OCSPStaple = raw
+	c.stapleExpiry = resp.NextUpdate
+	if !resp.NextUpdate.IsZero() {
+		c.nextStaple = resp.ThisUpdate.Add(resp.NextUpdate.Sub(resp.ThisUpdate) / 2)
+	}
+	return nil
+}
+
+func fetchOCSP(cert *tls.Certificate) ([]byte, *ocsp.Response, error) {
+	if len(cert.Certificate) < 2 {
+		return nil, nil, errors.New("certificate file doesn't include the issuer")
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, nil, err
+	}
+	issuer, err := x509.ParseCertificate(cert.Certificate[1])
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(leaf.OCSPServer) == 0 {
+		return nil, nil, errors.New("certificate names no OCSP responder")
+	}
+
+	req, err := ocsp.CreateRequest(leaf, issuer, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	httpResp, err := http.Post(leaf.OCSPServer[0], "application/ocsp-request", bytes.NewReader(req))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("%s: %s", leaf.OCSPServer[0], httpResp.Status)
+	}
+	raw, err := io.ReadAll(io.LimitReader(httpResp.Body, 1<<20))
+	if err != nil {
+		return nil, nil, err
+	}
+	resp, err := ocsp.ParseResponseForCert(raw, leaf, issuer)
+	if err != nil {
+		return nil, nil, err
+	}
+	return raw, resp, nil
+}
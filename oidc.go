@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// oidcProvider is an OpenID Connect identity provider that users log in with
+// through the authorization code flow. The client secret is read from
+// OIDC_CLIENT_SECRET.
+type oidcProvider struct {
+	issuer       string
+	clientID     string
+	clientSecret string
+	redirectURL  *url.URL
+
+	authURL  string
+	tokenURL string
+	keys     *jwks
+}
+
+func newOIDCProvider(issuer, clientID, redirectURL string) (*oidcProvider, error) {
+	redirect, err := url.Parse(redirectURL)
+	if err != nil {
+		return nil, err
+	}
+	body, err := httpGet(strings.TrimSuffix(issuer, "/") + "/.well-known/openid-configuration")
+	if err != nil {
+		return nil, err
+	}
+	var config struct {
+		Issuer                string `json:"issuer"`
+		AuthorizationEndpoint string `json:"authorization_endpoint"`
+		TokenEndpoint         string `json:"token_endpoint"`
+		JWKSURI               string `json:"jwks_uri"`
+	}
+	if err := json.Unmarshal(body, &config); err != nil {
+		return nil, err
+	}
+	if config.Issuer != issuer {
+		return nil, fmt.Errorf("provider claims to be issuer %s, not %s", config.Issuer, issuer)
+	}
+	return &oidcProvider{
+		issuer:       issuer,
+		clientID:     clientID,
+		clientSecret: os.Getenv("OIDC_CLIENT_SECRET"),
+		redirectURL:  redirect,
+		authURL:      config.AuthorizationEndpoint,
+		tokenURL:     config.TokenEndpoint,
+		keys:         &jwks{url: config.JWKSURI},
+	}, nil
+}
+
+func (p *oidcProvider) loginURL(state string) string {
+	q := url.Values{
+		"response_type": {"code"},
+		"client_id":     {p.clientID},
+		"redirect_uri":  {p.redirectURL.String()},
+		"scope":         {"openid email profile"},
+		"state":         {state},
+		"nonce":         {state},
+	}
+	return p.authURL + "?" + q.Encode()
+}
+
+// exchange redeems an authorization code and returns the claims of the
+// verified ID token.
+func (p *oidcProvider) exchange(ctx context.Context, code, nonce string) (map[string]any, error) {
+	form := url.Values{
+		"grant_type":   {"authorization_code"},
+		"code":         {code},
+		"redirect_uri": {p.redirectURL.String()},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(p.clientID), url.QueryEscape(p.clientSecret))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("POST %s: %s", p.tokenURL, resp.Status)
+	}
+	var tokens struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := json.Unmarshal(body, &tokens); err != nil {
+		return nil, err
+	}
+
+	claims, err := parseJWT(tokens.IDToken, func(kid string) (crypto.PublicKey, error) {
+		return p.keys.key(ctx, kid)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if claims["iss"] != p.issuer || !audience(claims, p.clientID) || claims["nonce"] != nonce {
+		return nil, errors.New("ID token isn't for this login")
+	}
+	return claims, nil
+}
+
+const oidcStateCookie = "fastserve_oidc_state"
+
+// requireLogin sends requests for paths matching s.loginPaths without a
+// session to log in with the OIDC provider first, and handles its callback.
+func (s *server) requireLogin(next http.HandlerFunc) http.HandlerFunc {
+	if s.oidc == nil {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == s.oidc.redirectURL.Path {
+			s.handleOIDCCallback(w, r)
+			return
+		}
+		if !matchAny(s.loginPaths, protectedPath(r.URL.Path)) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Cache-Control", "private")
+		if _, ok := s.session(r, "login"); ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		s.startLogin(w, r)
+	}
+}
+
+// startLogin sends the client to log in with the OIDC provider, to return to
+// r's URL afterwards.
+func (s *server) startLogin(w http.ResponseWriter, r *http.Request) {
+	state := newNonce()
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    signValue(s.sessionKeys, state+" "+r.URL.RequestURI(), time.Now().Add(10*time.Minute)),
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   s.requestScheme(r) == "https",
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, s.oidc.loginURL(state), http.StatusFound)
+}
+
+func (s *server) handleOIDCCallback(w http.ResponseWriter, r *http.Request) {
+	var state, returnTo string
+	if c, err := r.Cookie(oidcStateCookie); err == nil {
+		if value, ok := verifyValue(s.sessionKeys, c.Value); ok {
+			state, returnTo, _ = strings.Cut(value, " ")
+		}
+	}
+	if state == "" || r.URL.Query().Get("state") != state {
+		s.logViolation(r, "auth-failed")
+		http.Error(w, "login expired, try again", http.StatusUnauthorized)
+		return
+	}
+	claims, err := s.oidc.exchange(r.Context(), r.URL.Query().Get("code"), state)
+	if err != nil {
+		s.logViolation(r, "auth-failed")
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	subject, _ := claims["sub"].(string)
+
+	http.SetCookie(w, &http.Cookie{Name: oidcStateCookie, Path: "/", MaxAge: -1})
+	s.setSession(w, r, "login", subject)
+	if !strings.HasPrefix(returnTo, "/") || strings.HasPrefix(returnTo, "//") {
+		returnTo = "/"
+	}
+	http.Redirect(w, r, returnTo, http.StatusFound)
+}
+
+// protectedPath returns the cached path a request path is checked against
+// -login-path patterns as, looking through past versions at /_v/<id>/.
+func protectedPath(p string) string {
+	if rest, ok := strings.CutPrefix(p, "/_v/"); ok {
+		_, p, _ = strings.Cut(rest, "/")
+	}
+	return strings.TrimPrefix(p, "/")
+}
@@ -0,0 +1,19 @@
+package main
+
+import "net/http"
+
+// handleOptions returns the handler answering OPTIONS, both for a resource
+// and for the server as a whole (OPTIONS *), with allow, the methods the
+// server answers. Every path accepts the same methods, so the two don't
+// differ.
+func (s *server) handleOptions(allow string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Allow", allow)
+		if s.webdav {
+			// WebDAV class 1, read-only.
+			w.Header()["DAV"] = []string{"1"}
+			w.Header()["MS-Author-Via"] = []string{"DAV"}
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
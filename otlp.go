@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// otlp ships the log lines and requests to an OpenTelemetry collector, if
+// -otlp-endpoint is set.
+var otlp *otlpExporter
+
+// otlpExporter batches log records and posts them as OTLP/HTTP JSON to
+// /v1/logs under the endpoint, with the resource attributes and headers
+// of the standard OTEL_* environment variables, as tracers read them.
+type otlpExporter struct {
+	url      string
+	headers  map[string]string
+	resource []otlpAttr
+	records  chan otlpRecord
+}
+
+type otlpRecord struct {
+	TimeUnixNano   string     `json:"timeUnixNano"`
+	SeverityNumber int        `json:"severityNumber"`
+	SeverityText   string     `json:"severityText"`
+	Body           otlpValue  `json:"body"`
+	Attributes     []otlpAttr `json:"attributes,omitempty"`
+}
+
+type otlpAttr struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+// otlpValue is an AnyValue, with 64-bit integers as strings as in the
+// protobuf JSON mapping.
+type otlpValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+}
+
+func stringAttr(key, value string) otlpAttr {
+	return otlpAttr{Key: key, Value: otlpValue{StringValue: &value}}
+}
+
+func intAttr(key string, value int64) otlpAttr {
+	s := strconv.FormatInt(value, 10)
+	return otlpAttr{Key: key, Value: otlpValue{IntValue: &s}}
+}
+
+func newOTLPExporter(endpoint string) *otlpExporter {
+	e := &otlpExporter{
+		url:     strings.TrimSuffix(endpoint, "/") + "/v1/logs",
+		headers: parseOTELList(os.Getenv("OTEL_EXPORTER_OTLP_HEADERS")),
+		records: make(chan otlpRecord, 4096),
+	}
+	resource := parseOTELList(os.Getenv("OTEL_RESOURCE_ATTRIBUTES"))
+	if name := os.Getenv("OTEL_SERVICE_NAME"); name != "" {
+		resource["service.name"] = name
+	} else if resource["service.name"] == "" {
+		resource["service.name"] = "fastserve"
+	}
+	if host, err := os.Hostname(); err == nil && resource["host.name"] == "" {
+		resource["host.name"] = host
+	}
+	for key, value := range resource {
+		e.resource = append(e.resource, stringAttr(key, value))
+	}
+	go e.run()
+	return e
+}
+
+// parseOTELList parses the key=value,... lists of the OTEL_* variables.
+func parseOTELList(s string) map[string]string {
+	m := make(map[string]string)
+	for _, pair := range strings.Split(s, ",") {
+		if key, value, ok := strings.Cut(pair, "="); ok {
+			m[strings.TrimSpace(key)] = strings.TrimSpace(value)
+		}
+	}
+	return m
+}
+
+var otlpSeverities = [...]struct {
+	number int
+	text   string
+}{
+	levelDebug: {5, "DEBUG"},
+	levelInfo:  {9, "INFO"},
+	levelWarn:  {13, "WARN"},
+	levelError: {17, "ERROR"},
+}
+
+// export queues a record, dropping it if the collector can't keep up.
+func (e *otlpExporter) export(level logLevel, msg string, attrs ...otlpAttr) {
+	severity := otlpSeverities[level]
+	r := otlpRecord{
+		TimeUnixNano:   strconv.FormatInt(time.Now().UnixNano(), 10),
+		SeverityNumber: severity.number,
+		SeverityText:   severity.text,
+		Body:           otlpValue{StringValue: &msg},
+		Attributes:     attrs,
+	}
+	select {
+	case e.records <- r:
+	default:
+	}
+}
+
+// exportRequest queues the access log record of a request.
+func (e *otlpExporter) exportRequest(r *http.Request, status int, size int64, elapsed time.Duration) {
+	e.export(levelInfo, r.Method+" "+r.URL.Path,
+		stringAttr("http.request.method", r.Method),
+		stringAttr("url.path", r.URL.Path),
+		stringAttr("server.address", requestHost(r)),
+		stringAttr("client.address", r.RemoteAddr),
+		stringAttr("user_agent.original", r.UserAgent()),
+		intAttr("http.response.status_code", int64(status)),
+		intAttr("http.response.body.size", size),
+		otlpAttr{Key: "duration_ms", Value: otlpValue{DoubleValue: ptr(float64(elapsed.Microseconds()) / 1000)}},
+	)
+}
+
+func ptr[T any](v T) *T { return &v }
+
+// run posts the queued records every second, or every 512 records.
+func (e *otlpExporter) run() {
+	ticker := time.NewTicker(time.Second)
+	var batch []otlpRecord
+	for {
+		select {
+		case r := <-e.records:
+			if batch = append(batch, r); len(batch) < 512 {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+		// Not logged with errorf, which would export the failure too.
+		if err := e.post(batch); err != nil {
+			log.Printf("exporting %d log records: %v", len(batch), err)
+		}
+		batch = batch[:0]
+	}
+}
+
+func (e *otlpExporter) post(records []otlpRecord) error {
+	type scopeLogs struct {
+		Scope struct {
+			Name string `json:"name"`
+		} `json:"scope"`
+		LogRecords []otlpRecord `json:"logRecords"`
+	}
+	var scope scopeLogs
+	scope.Scope.Name = "fastserve"
+	scope.LogRecords = records
+	body, err := json.Marshal(map[string]any{
+		"resourceLogs": []any{map[string]any{
+			"resource":  map[string]any{"attributes": e.resource},
+			"scopeLogs": []scopeLogs{scope},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, e.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range e.headers {
+		req.Header.Set(key, value)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s: %s", e.url, resp.Status)
+	}
+	return nil
+}
+
+// statusWriter records the status and size of a response for its access
+// log record.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	size   int64
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.size += int64(n)
+	return n, err
+}
+
+// ReadFrom passes files through to the connection, keeping sendfile.
+func (w *statusWriter) ReadFrom(src io.Reader) (int64, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := io.Copy(w.ResponseWriter, src)
+	w.size += n
+	return n, err
+}
+
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
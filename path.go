@@ -0,0 +1,70 @@
+package main
+
+import (
+	"path"
+	"strings"
+)
+
+// canonicalPath cleans a decoded request path the way http.ServeMux does,
+// collapsing duplicate slashes and resolving . and .. segments without ever
+// leaving the root, while keeping any trailing slash. It reports false for
+// paths that can never name a file.
+func canonicalPath(p string) (string, bool) {
+	if strings.IndexByte(p, 0) >= 0 {
+		return "", false
+	}
+	if isClean(p) {
+		return p, true
+	}
+	clean := path.Clean("/" + p)
+	if strings.HasSuffix(p, "/") && clean != "/" {
+		clean += "/"
+	}
+	return clean, true
+}
+
+// isClean reports whether p is already the path canonicalPath would return,
+// sparing the common case the allocations of path.Clean.
+func isClean(p string) bool {
+	if p == "" || p[0] != '/' {
+		return false
+	}
+	for _, seg := range []string{"//", "/./", "/../"} {
+		if strings.Contains(p, seg) {
+			return false
+		}
+	}
+	return !strings.HasSuffix(p, "/.") && !strings.HasSuffix(p, "/..")
+}
+
+// indexFolded maps case-folded paths to the cached paths they fold from. It
+// must be called with s.mu held.
+func (s *server) indexFolded() {
+	s.folded = nil
+	if !s.caseInsensitive {
+		return
+	}
+	s.folded = make(map[string]string)
+	for p := range s.cache.all() {
+		s.folded[strings.ToLower(p)] = p
+	}
+	for p := range s.variants {
+		s.folded[strings.ToLower(p)] = p
+	}
+}
+
+// foldPath returns the cached path that differs from p only in case, if p
+// itself isn't cached. It must be called with s.mu held.
+func (s *server) foldPath(p string) (string, bool) {
+	if s.folded == nil {
+		return "", false
+	}
+	if _, ok := s.cache.lookup(p); ok {
+		return "", false
+	}
+	if _, ok := s.variants[p]; ok {
+		return "", false
+	}
+	canonical, ok := s.folded[strings.ToLower(p)]
+	return canonical, ok
+}
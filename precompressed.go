@@ -0,0 +1,97 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+// precompressed are the compressed siblings of a file found in the tree,
+// such as app.js.br and app.js.gz beside app.js, as a build produces them.
+type precompressed struct {
+	br, gzip *fileCache
+}
+
+// indexPrecompressed finds the siblings of the files of a load. Siblings
+// older than their file are left out, as built for an earlier version, and
+// so are those of files served otherwise than as they are on disk: stamped
+// with a nonce under -csp or changed by -transform.
+func indexPrecompressed(cache *fileIndex) map[string]precompressed {
+	siblings := make(map[string]precompressed)
+	for path, entry := range cache.all() {
+		var base string
+		var br bool
+		if b, ok := strings.CutSuffix(path, ".br"); ok {
+			base, br = b, true
+		} else if b, ok := strings.CutSuffix(path, ".gz"); ok {
+			base = b
+		} else {
+			continue
+		}
+		file := cache.get(base)
+		if file == nil || file.scripts != nil || file.transformed {
+			continue
+		}
+		if entry.sourceModTime.Before(file.sourceModTime) {
+			debugf("not serving %s for %s, it's older", path, base)
+			continue
+		}
+		pre := siblings[base]
+		if br {
+			pre.br = entry
+		} else {
+			pre.gzip = entry
+		}
+		siblings[base] = pre
+	}
+	return siblings
+}
+
+// pick returns the sibling to serve for r and its content coding, brotli
+// if the client accepts both.
+func (pre precompressed) pick(r *http.Request) (string, *fileCache) {
+	if pre.br != nil && accepts(r, "br") {
+		return "br", pre.br
+	}
+	if pre.gzip != nil && accepts(r, "gzip") {
+		return "gzip", pre.gzip
+	}
+	return "", nil
+}
+
+// serveSibling serves the compressed sibling of a file as the file, with
+// the content type of the file and the validators of the sibling.
+func (s *server) serveSibling(w http.ResponseWriter, r *http.Request, path, coding string, cached, sibling *fileCache) {
+	h := w.Header()
+	h.Set("Content-Encoding", coding)
+	h["Content-Type"] = cached.headers.contentType
+	if sibling.headers.etag != nil {
+		h["Etag"] = sibling.headers.etag
+	}
+	modTime := sibling.modTime
+	if sibling.headers.lastModified == nil {
+		modTime = time.Time{}
+	}
+	if sibling.file != "" {
+		f, err := sibling.open()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer f.Close()
+		http.ServeContent(w, r, path, modTime, f)
+		return
+	}
+	if plainRequest(r) {
+		if sibling.headers.lastModified != nil {
+			h["Last-Modified"] = sibling.headers.lastModified
+		}
+		h["Content-Length"] = sibling.headers.contentLength
+		w.WriteHeader(http.StatusOK)
+		if r.Method != http.MethodHead {
+			w.Write(sibling.content)
+		}
+		return
+	}
+	serveBytes(w, r, path, modTime, sibling.content)
+}
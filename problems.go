@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// fileProblem is a file left out of the cache by the last load.
+type fileProblem struct {
+	Path    string `json:"path"`
+	Problem string `json:"problem"`
+	Error   string `json:"error"`
+}
+
+var (
+	errSymlinkOutside = errors.New("symlink outside root")
+	errSymlinkLoop    = errors.New("symlink loop")
+)
+
+// skip logs a file left out of the load being built because of err, and
+// records it as a problem.
+func (s *server) skip(path string, err error) {
+	warnf("skipping %v", err)
+	s.addProblem(path, problemKind(path, err), err.Error())
+}
+
+func (s *server) addProblem(path, kind, msg string) {
+	if rel, err := filepath.Rel(s.dir, path); err == nil && !strings.HasPrefix(rel, "..") {
+		path = filepath.ToSlash(rel)
+	}
+	s.loadProblems = append(s.loadProblems, fileProblem{Path: path, Problem: kind, Error: msg})
+}
+
+func problemKind(path string, err error) string {
+	switch {
+	case errors.Is(err, errSymlinkOutside):
+		return "symlink-outside-root"
+	case errors.Is(err, errSymlinkLoop):
+		return "symlink-loop"
+	case errors.Is(err, fs.ErrPermission):
+		return "permission-denied"
+	case errors.Is(err, fs.ErrNotExist):
+		if info, lerr := os.Lstat(path); lerr == nil && info.Mode()&os.ModeSymlink != 0 {
+			return "broken-symlink"
+		}
+		return "not-found"
+	}
+	return "read-error"
+}
+
+// oversized reports whether a file is left out only for being larger than
+// -ignore-larger-than, and records it as a problem if so.
+func (s *server) oversized(relPath string, info os.FileInfo, ignore regexp.Regexp) bool {
+	if s.maxFileSize == 0 || info.Size() <= s.maxFileSize || !s.included(relPath) ||
+		s.ignoreExts[strings.ToLower(filepath.Ext(relPath))] || ignore.MatchString(relPath) {
+		return false
+	}
+	s.addProblem(relPath, "too-large", fmt.Sprintf("%d bytes, over -ignore-larger-than of %d", info.Size(), s.maxFileSize))
+	return true
+}
+
+// logProblems summarizes the problems of the first load by kind.
+func logProblems(problems []fileProblem) {
+	if len(problems) == 0 {
+		return
+	}
+	counts := make(map[string]int)
+	for _, p := range problems {
+		counts[p.Problem]++
+	}
+	kinds := make([]string, 0, len(counts))
+	for kind, n := range counts {
+		kinds = append(kinds, fmt.Sprintf("%d %s", n, kind))
+	}
+	sort.Strings(kinds)
+	warnf("left %d files out: %s; listed at /_/problems", len(problems), strings.Join(kinds, ", "))
+}
+
+// handleProblems lists the files left out by the last load as JSON.
+func (s *server) handleProblems(w http.ResponseWriter, r *http.Request) {
+	s.mu.RLock()
+	problems := s.problems
+	s.mu.RUnlock()
+	if problems == nil {
+		problems = []fileProblem{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(problems)
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// A publisher receives the files changed by a refresh, turning fastserve
+// into a deploy tool for another origin.
+type publisher interface {
+	put(path string, entry *fileCache) error
+	remove(path string) error
+}
+
+// newPublisher returns a publisher for an s3://bucket/prefix URI, or one
+// sending PUT and DELETE requests under an http(s) base URL.
+func newPublisher(target, s3Region, s3Endpoint string) (publisher, error) {
+	if strings.HasPrefix(target, "s3://") {
+		return newS3Client(target, s3Region, s3Endpoint)
+	}
+	if !strings.HasPrefix(target, "http://") && !strings.HasPrefix(target, "https://") {
+		return nil, fmt.Errorf("invalid publish target %q", target)
+	}
+	return httpPublisher(strings.TrimSuffix(target, "/")), nil
+}
+
+type httpPublisher string
+
+func (p httpPublisher) put(path string, entry *fileCache) error {
+	content, err := entry.bytes()
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPut, p.url(path), bytes.NewReader(content))
+	if err != nil {
+		return err
+	}
+	if entry.contentType != "" {
+		req.Header.Set("Content-Type", entry.contentType)
+	}
+	return sendRequest(req)
+}
+
+func (p httpPublisher) remove(path string) error {
+	req, err := http.NewRequest(http.MethodDelete, p.url(path), nil)
+	if err != nil {
+		return err
+	}
+	return sendRequest(req)
+}
+
+func (p httpPublisher) url(path string) string {
+	u := url.URL{Path: "/" + path}
+	return string(p) + u.EscapedPath()
+}
+
+// publishChanges returns a change hook uploading changed files to pub and
+// removing deleted ones, one refresh at a time in the background.
+func (s *server) publishChanges(pub publisher) func(changeSet) {
+	var mu sync.Mutex
+	return func(c changeSet) {
+		go func() {
+			mu.Lock()
+			defer mu.Unlock()
+			for _, path := range c.changed() {
+				s.mu.RLock()
+				entry := s.cache.get(path)
+				s.mu.RUnlock()
+				if entry == nil {
+					continue
+				}
+				if err := pub.put(path, entry); err != nil {
+					errorf("publish: %v", err)
+					continue
+				}
+				infof("published %s", path)
+			}
+			for _, path := range c.Removed {
+				if err := pub.remove(path); err != nil {
+					errorf("publish: %v", err)
+					continue
+				}
+				infof("unpublished %s", path)
+			}
+		}()
+	}
+}
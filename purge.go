@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// cdnPurger purges changed URLs from a CDN's cache, authenticating with the
+// CLOUDFLARE_API_TOKEN or FASTLY_API_TOKEN environment variable.
+type cdnPurger struct {
+	provider string
+	baseURL  string
+	zone     string
+	token    string
+}
+
+func newCDNPurger(provider, baseURL, zone string) (*cdnPurger, error) {
+	p := &cdnPurger{provider: provider, baseURL: strings.TrimSuffix(baseURL, "/"), zone: zone}
+	switch provider {
+	case "cloudflare":
+		p.token = os.Getenv("CLOUDFLARE_API_TOKEN")
+		if zone == "" {
+			return nil, fmt.Errorf("cloudflare purging needs -purge-zone")
+		}
+	case "fastly":
+		p.token = os.Getenv("FASTLY_API_TOKEN")
+	default:
+		return nil, fmt.Errorf("unknown purge provider %q", provider)
+	}
+	if baseURL == "" {
+		return nil, fmt.Errorf("purging needs -public-url")
+	}
+	return p, nil
+}
+
+// publicURLs returns the URLs under baseURL the paths are served at, which
+// for index.html include its directory.
+func publicURLs(baseURL string, paths []string) []string {
+	var urls []string
+	for _, path := range paths {
+		u := url.URL{Path: "/" + path}
+		urls = append(urls, baseURL+u.EscapedPath())
+		if dir, ok := strings.CutSuffix(u.EscapedPath(), "index.html"); ok {
+			urls = append(urls, baseURL+dir)
+		}
+	}
+	return urls
+}
+
+func (p *cdnPurger) purge(c changeSet) {
+	urls := publicURLs(p.baseURL, append(c.changed(), c.Removed...))
+	var err error
+	switch p.provider {
+	case "cloudflare":
+		err = p.purgeCloudflare(urls)
+	case "fastly":
+		err = p.purgeFastly(urls)
+	}
+	if err != nil {
+		errorf("purge: %v", err)
+		return
+	}
+	infof("purged %d URLs from %s", len(urls), p.provider)
+}
+
+func (p *cdnPurger) purgeCloudflare(urls []string) error {
+	const batch = 30
+	for len(urls) > 0 {
+		n := min(batch, len(urls))
+		body, _ := json.Marshal(map[string][]string{"files": urls[:n]})
+		urls = urls[n:]
+		req, err := http.NewRequest(http.MethodPost, "https://api.cloudflare.com/client/v4/zones/"+url.PathEscape(p.zone)+"/purge_cache", bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+p.token)
+		req.Header.Set("Content-Type", "application/json")
+		if err := sendRequest(req); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *cdnPurger) purgeFastly(urls []string) error {
+	for _, u := range urls {
+		req, err := http.NewRequest("PURGE", u, nil)
+		if err != nil {
+			return err
+		}
+		if p.token != "" {
+			req.Header.Set("Fastly-Key", p.token)
+		}
+		if err := sendRequest(req); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sendRequest sends a request whose response body is of no interest,
+// failing unless it succeeds.
+func sendRequest(req *http.Request) error {
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s %s: %s", req.Method, req.URL, resp.Status)
+	}
+	return nil
+}
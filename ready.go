@@ -0,0 +1,27 @@
+package main
+
+import "net/http"
+
+// awaitReady answers requests with 503 until the initial load is done, for
+// servers listening before it with -bind-early. Status requests still go
+// through.
+func (s *server) awaitReady(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.ready.Load() || r.URL.Path == "/_/status" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Retry-After", "5")
+		http.Error(w, "starting up", http.StatusServiceUnavailable)
+	}
+}
+
+// handleReady answers 200 once the initial load is done and 503 until then,
+// for load balancer health checks.
+func (s *server) handleReady(w http.ResponseWriter, r *http.Request) {
+	if !s.ready.Load() {
+		http.Error(w, "starting up", http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("ready\n"))
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"errors"
+	"math/rand/v2"
+	"regexp"
+	"time"
+)
+
+// refreshStats describes the last load of the files, and counts all loads.
+type refreshStats struct {
+	At         time.Time `json:"at"`
+	DurationMS float64   `json:"durationMs"`
+	BytesRead  int64     `json:"bytesRead"`
+	Added      int       `json:"added"`
+	Modified   int       `json:"modified"`
+	Removed    int       `json:"removed"`
+	Skipped    int       `json:"skipped"`
+	Error      string    `json:"error,omitempty"`
+
+	Refreshes int `json:"refreshes"`
+	Failures  int `json:"failures"`
+	Overlaps  int `json:"overlaps"`
+}
+
+var errRefreshing = errors.New("previous refresh still running")
+
+// refresh loads the files, recording how it went in s.refreshStats. It
+// returns errRefreshing rather than start a load while one is running.
+func (s *server) refresh(ignore regexp.Regexp) error {
+	if !s.refreshing.CompareAndSwap(false, true) {
+		s.mu.Lock()
+		s.refreshStats.Overlaps++
+		s.mu.Unlock()
+		return errRefreshing
+	}
+	defer s.refreshing.Store(false)
+
+	start := time.Now()
+	s.bytesRead.Store(0)
+	s.filesRead.Store(0)
+	s.loadBytes, s.loadOverflow, s.loadProblems = 0, 0, nil
+	s.loadContents, s.loadShared = make(map[string]*fileCache), 0
+	s.mu.Lock()
+	s.lastChanges = changeSet{}
+	s.mu.Unlock()
+
+	if !s.loaded() {
+		done := make(chan struct{})
+		defer close(done)
+		go s.logProgress(start, done)
+	}
+	err := s.loadFiles(ignore)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stats := &s.refreshStats
+	stats.At = start
+	stats.DurationMS = float64(time.Since(start).Microseconds()) / 1000
+	stats.BytesRead = s.bytesRead.Load()
+	stats.Added = len(s.lastChanges.Added)
+	stats.Modified = len(s.lastChanges.Modified)
+	stats.Removed = len(s.lastChanges.Removed)
+	stats.Skipped = s.skipped
+	stats.Error = ""
+	stats.Refreshes++
+	if err != nil {
+		stats.Error = err.Error()
+		stats.Failures++
+	}
+	return err
+}
+
+// logProgress logs how many files were read every few seconds until done,
+// for the initial load of a large tree.
+func (s *server) logProgress(start time.Time, done <-chan struct{}) {
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			bytes := s.bytesRead.Load()
+			elapsed := time.Since(start)
+			infof("loaded %d files, %d MB in %v, %.1f MB/s", s.filesRead.Load(), bytes>>20, elapsed.Round(time.Second), float64(bytes)/(1<<20)/elapsed.Seconds())
+		}
+	}
+}
+
+// refreshEvery refreshes servers every interval plus a random jitter of up
+// to jitter, so that a fleet started together doesn't hit shared storage at
+// once. The interval is measured from the start of a refresh; when
+// refreshing takes longer, the missed cycles are skipped with a warning
+// rather than starting the next right away. It returns once stop is closed.
+func refreshEvery(servers []*server, ignore regexp.Regexp, interval, jitter time.Duration, stop <-chan struct{}) {
+	next := time.Now()
+	for {
+		next = next.Add(interval)
+		if jitter > 0 {
+			next = next.Add(rand.N(jitter))
+		}
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-timer.C:
+		case <-stop:
+			timer.Stop()
+			return
+		}
+
+		start := time.Now()
+		for _, srv := range servers {
+			srvStart := time.Now()
+			if err := srv.refresh(ignore); err != nil {
+				errorf("refreshing %s: %v", srv.dir, err)
+				continue
+			}
+			srv.mu.RLock()
+			skipped := srv.skipped
+			srv.mu.RUnlock()
+			infof("refreshed %s in %v, skipped %d files", srv.dir, time.Since(srvStart), skipped)
+		}
+		if took := time.Since(start); took > interval {
+			missed := int(took / interval)
+			warnf("refreshing took %v, longer than the %v interval; skipping %d refreshes", took, interval, missed)
+			servers[0].mu.Lock()
+			servers[0].refreshStats.Overlaps += missed
+			servers[0].mu.Unlock()
+			next = next.Add(time.Duration(missed) * interval)
+		}
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// configReloader serves the sites of the -config file, and applies changes
+// to it without a restart once they have all loaded, keeping the sites and
+// listeners that didn't change.
+type configReloader struct {
+	path   string
+	sites  *siteList
+	static []site
+
+	// build returns a site for sc with its files loaded, and run starts
+	// refreshing it.
+	build func(sc siteConfig) (*site, error)
+	run   func(st *site)
+
+	// Listeners take their timeouts from base and, for sites with a
+	// certificate, their TLS settings from newTLS.
+	base   *http.Server
+	newTLS func() (*tls.Config, error)
+
+	configs   []siteConfig
+	current   []site
+	listeners map[string]*siteListener
+	modTime   time.Time
+}
+
+// siteListener serves whichever site is configured for its addr.
+type siteListener struct {
+	server *http.Server
+	ln     net.Listener
+	tls    bool
+	site   atomic.Pointer[site]
+}
+
+// load reads the file and applies it, recording its modification time
+// only once it has been, so a file that fails is tried again.
+func (c *configReloader) load() error {
+	info, err := os.Stat(c.path)
+	if err != nil {
+		return err
+	}
+	conf, err := loadConfig(c.path)
+	if err != nil {
+		return err
+	}
+	if err := c.apply(conf); err != nil {
+		return err
+	}
+	c.modTime = info.ModTime()
+	return nil
+}
+
+// apply builds the sites of conf that changed and swaps them in, or leaves
+// the current ones serving if any of them fails.
+func (c *configReloader) apply(conf config) error {
+	kept := make(map[int]bool)
+	var next, built []site
+	for i, sc := range conf.Sites {
+		if j := c.find(sc, kept); j >= 0 {
+			kept[j] = true
+			next = append(next, c.current[j])
+			continue
+		}
+		st, err := c.build(sc)
+		if err != nil {
+			return fmt.Errorf("site %d: %v", i+1, err)
+		}
+		next = append(next, *st)
+		built = append(built, *st)
+	}
+
+	hosts := make(map[string]bool)
+	for _, st := range c.static {
+		hosts[st.host] = true
+	}
+	addrs := make(map[string]bool)
+	for _, st := range next {
+		if st.host != "" && hosts[st.host] {
+			return fmt.Errorf("host %s is served by more than one site", st.host)
+		}
+		hosts[st.host] = true
+		if st.addr == "" {
+			continue
+		}
+		if addrs[st.addr] {
+			return fmt.Errorf("addr %s is served by more than one site", st.addr)
+		}
+		addrs[st.addr] = true
+		if l := c.listeners[st.addr]; l != nil && l.tls != (st.certs != nil) {
+			return fmt.Errorf("the site on %s can't switch TLS without a restart", st.addr)
+		}
+	}
+	opened := make(map[string]*siteListener)
+	for i := range next {
+		st := &next[i]
+		if st.addr == "" || c.listeners[st.addr] != nil {
+			continue
+		}
+		l, err := c.listen(st)
+		if err != nil {
+			for _, l := range opened {
+				l.ln.Close()
+			}
+			return err
+		}
+		opened[st.addr] = l
+	}
+
+	for i := range built {
+		c.run(&built[i])
+	}
+	c.sites.store(append(append([]site(nil), c.static...), next...))
+	if c.listeners == nil {
+		c.listeners = make(map[string]*siteListener)
+	}
+	for i := range next {
+		st := &next[i]
+		if l := c.listeners[st.addr]; l != nil {
+			l.site.Store(st)
+		} else if l := opened[st.addr]; l != nil {
+			l.site.Store(st)
+			c.listeners[st.addr] = l
+			go l.serve()
+		}
+	}
+	for addr, l := range c.listeners {
+		if !addrs[addr] {
+			delete(c.listeners, addr)
+			go l.shutdown()
+		}
+	}
+	for j, st := range c.current {
+		if !kept[j] {
+			close(st.stop)
+		}
+	}
+	c.configs, c.current = conf.Sites, next
+	for _, st := range built {
+		if st.host != "" {
+			infof("serving %s for %s", st.dir, st.host)
+		}
+	}
+	return nil
+}
+
+// find returns the index of a current site configured as sc and not kept
+// yet, or -1.
+func (c *configReloader) find(sc siteConfig, kept map[int]bool) int {
+	for j, prev := range c.configs {
+		if !kept[j] && reflect.DeepEqual(prev, sc) {
+			return j
+		}
+	}
+	return -1
+}
+
+// listen binds the addr of st, to be served once st is swapped in.
+func (c *configReloader) listen(st *site) (*siteListener, error) {
+	l := &siteListener{tls: st.certs != nil}
+	l.server = &http.Server{
+		Addr:              st.addr,
+		Handler:           http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { l.site.Load().own.ServeHTTP(w, r) }),
+		ReadTimeout:       c.base.ReadTimeout,
+		ReadHeaderTimeout: c.base.ReadHeaderTimeout,
+		WriteTimeout:      c.base.WriteTimeout,
+		IdleTimeout:       c.base.IdleTimeout,
+		MaxHeaderBytes:    c.base.MaxHeaderBytes,
+
+		DisableGeneralOptionsHandler: true,
+	}
+	if l.tls {
+		var err error
+		if l.server.TLSConfig, err = c.newTLS(); err != nil {
+			return nil, err
+		}
+		l.server.TLSConfig.GetCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return l.site.Load().certs.getCertificate(hello)
+		}
+	}
+	var err error
+	if l.ln, err = net.Listen("tcp", st.addr); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *siteListener) serve() {
+	infof("serving %s on %s", l.site.Load().dir, l.server.Addr)
+	var err error
+	if l.tls {
+		err = l.server.ServeTLS(l.ln, "", "")
+	} else {
+		err = l.server.Serve(l.ln)
+	}
+	if err != http.ErrServerClosed {
+		errorf("serving on %s: %v", l.server.Addr, err)
+	}
+}
+
+// shutdown stops the listener, giving requests in flight a while to finish.
+func (l *siteListener) shutdown() {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := l.server.Shutdown(ctx); err != nil {
+		l.server.Close()
+	}
+	infof("stopped serving on %s", l.server.Addr)
+}
+
+// watch polls the file for changes and listens for SIGHUP, applying a
+// changed file or logging why it wasn't.
+func (c *configReloader) watch() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	ticker := time.NewTicker(10 * time.Second)
+	for {
+		select {
+		case <-hup:
+		case <-ticker.C:
+			info, err := os.Stat(c.path)
+			if err != nil || info.ModTime().Equal(c.modTime) {
+				continue
+			}
+		}
+		if err := c.load(); err != nil {
+			warnf("not reloading %s: %v", c.path, err)
+			continue
+		}
+		infof("reloaded %s", c.path)
+	}
+}
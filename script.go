@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
+	"go.starlark.net/syntax"
+)
+
+// script is a Starlark script customizing requests and content. It may
+// define
+//
+//	on_request(req)
+//
+// called for every request with req.method, req.path, req.host, req.query
+// and req.headers, a dict of the first value of each header, and
+//
+//	on_refresh(path, content)
+//
+// called for every file when it's cached with its content as a string.
+// on_request returns None to carry on, or a dict with any of "path" to serve
+// instead, "headers" to set on the response, and "status" and "body" to answer
+// with. on_refresh returns the content to cache, or None to keep it.
+type script struct {
+	name      string
+	onRequest starlark.Callable
+	onRefresh starlark.Callable
+}
+
+// scriptSteps bounds the work one call of a script may do.
+const scriptSteps = 1000000
+
+func loadScript(name string) (*script, error) {
+	thread := &starlark.Thread{Name: name}
+	globals, err := starlark.ExecFileOptions(syntax.LegacyFileOptions(), thread, name, nil, starlark.StringDict{
+		"struct": starlark.NewBuiltin("struct", starlarkstruct.Make),
+	})
+	if err != nil {
+		return nil, err
+	}
+	sc := &script{name: name}
+	for fn, callable := range map[string]*starlark.Callable{"on_request": &sc.onRequest, "on_refresh": &sc.onRefresh} {
+		if v, ok := globals[fn]; ok {
+			if *callable, ok = v.(starlark.Callable); !ok {
+				return nil, fmt.Errorf("%s: %s isn't a function", name, fn)
+			}
+		}
+	}
+	return sc, nil
+}
+
+func (sc *script) call(fn starlark.Callable, args ...starlark.Value) (starlark.Value, error) {
+	thread := &starlark.Thread{Name: sc.name}
+	thread.SetMaxExecutionSteps(scriptSteps)
+	return starlark.Call(thread, fn, args, nil)
+}
+
+// transform returns content as changed by on_refresh.
+func (sc *script) transform(relPath string, content []byte) []byte {
+	if sc == nil || sc.onRefresh == nil {
+		return content
+	}
+	v, err := sc.call(sc.onRefresh, starlark.String(relPath), starlark.String(content))
+	if err != nil {
+		errorf("%s: on_refresh %s: %v", sc.name, relPath, err)
+		return content
+	}
+	if s, ok := v.(starlark.String); ok {
+		return []byte(s)
+	}
+	return content
+}
+
+// runScript passes each request through on_request.
+func (s *server) runScript(next http.HandlerFunc) http.HandlerFunc {
+	if s.script == nil || s.script.onRequest == nil {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		headers := starlark.NewDict(len(r.Header))
+		for name := range r.Header {
+			headers.SetKey(starlark.String(strings.ToLower(name)), starlark.String(r.Header.Get(name)))
+		}
+		req := starlarkstruct.FromStringDict(starlarkstruct.Default, starlark.StringDict{
+			"method":  starlark.String(r.Method),
+			"path":    starlark.String(r.URL.Path),
+			"host":    starlark.String(r.Host),
+			"query":   starlark.String(r.URL.RawQuery),
+			"headers": headers,
+		})
+		v, err := s.script.call(s.script.onRequest, req)
+		if err != nil {
+			errorf("%s: on_request %s: %v", s.script.name, r.URL.Path, err)
+			http.Error(w, "script failed", http.StatusInternalServerError)
+			return
+		}
+		result, ok := v.(*starlark.Dict)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if v, ok, _ := result.Get(starlark.String("headers")); ok {
+			if set, ok := v.(*starlark.Dict); ok {
+				for _, item := range set.Items() {
+					name, _ := starlark.AsString(item[0])
+					value, _ := starlark.AsString(item[1])
+					w.Header().Set(name, value)
+				}
+			}
+		}
+		if v, ok, _ := result.Get(starlark.String("status")); ok {
+			status, err := starlark.AsInt32(v)
+			if err == nil && (status < 100 || status > 599) {
+				err = fmt.Errorf("status %d out of range", status)
+			}
+			if err != nil {
+				errorf("%s: on_request %s: %v", s.script.name, r.URL.Path, err)
+				http.Error(w, "script failed", http.StatusInternalServerError)
+				return
+			}
+			body := ""
+			if v, ok, _ := result.Get(starlark.String("body")); ok {
+				body, _ = starlark.AsString(v)
+			}
+			w.WriteHeader(status)
+			fmt.Fprint(w, body)
+			return
+		}
+		if v, ok, _ := result.Get(starlark.String("path")); ok {
+			if path, ok := starlark.AsString(v); ok && strings.HasPrefix(path, "/") {
+				r2 := r.Clone(r.Context())
+				r2.URL.Path, r2.URL.RawPath = path, ""
+				r = r2
+			}
+		}
+		next.ServeHTTP(w, r)
+	}
+}
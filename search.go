@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"html"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const maxSearchResults = 20
+
+var (
+	htmlSkipped = regexp.MustCompile(`(?is)<(script|style)\b.*?</(script|style)>|<!--.*?-->`)
+	htmlTag     = regexp.MustCompile(`(?s)<[^>]*>`)
+	whitespace  = regexp.MustCompile(`\s+`)
+)
+
+func searchable(path string) bool {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".html", ".htm", ".md", ".markdown", ".txt":
+		return true
+	}
+	return false
+}
+
+// plainText returns the visible text of a document.
+func plainText(path string, content []byte) string {
+	text := string(content)
+	if isHTML(path) {
+		text = htmlSkipped.ReplaceAllString(text, " ")
+		text = html.UnescapeString(htmlTag.ReplaceAllString(text, " "))
+	}
+	return strings.TrimSpace(whitespace.ReplaceAllString(text, " "))
+}
+
+func tokenize(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// searchWords returns the distinct words of a document for the search index.
+func searchWords(path string, content []byte) []string {
+	seen := make(map[string]bool)
+	var words []string
+	for _, word := range tokenize(plainText(path, content)) {
+		if !seen[word] {
+			seen[word] = true
+			words = append(words, word)
+		}
+	}
+	return words
+}
+
+// indexSearch builds the inverted index from the words of every cached
+// document. It must be called with s.mu held.
+func (s *server) indexSearch() {
+	s.searchIndex = make(map[string][]string)
+	for path, entry := range s.cache.all() {
+		for _, word := range entry.words {
+			s.searchIndex[word] = append(s.searchIndex[word], path)
+		}
+	}
+	for _, paths := range s.searchIndex {
+		sort.Strings(paths)
+	}
+}
+
+type searchResult struct {
+	Path    string `json:"path"`
+	Snippet string `json:"snippet"`
+}
+
+// handleSearch returns the documents containing every word of the q query
+// parameter, with a snippet around the first match.
+func (s *server) handleSearch(w http.ResponseWriter, r *http.Request) {
+	terms := tokenize(r.URL.Query().Get("q"))
+	results := []searchResult{}
+
+	a := s.requestAccess(r)
+	s.mu.RLock()
+	var matches []string
+	for i, term := range terms {
+		paths := s.searchIndex[term]
+		if i == 0 {
+			matches = paths
+			continue
+		}
+		matches = intersectSorted(matches, paths)
+	}
+	for _, path := range matches {
+		if len(results) == maxSearchResults {
+			break
+		}
+		entry := s.cache.get(path)
+		if hidden, _ := s.hidden(path, entry); hidden || !a.allows(path, entry) {
+			continue
+		}
+		results = append(results, searchResult{path, snippet(plainText(path, entry.content), terms[0])})
+	}
+	s.mu.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"results": results})
+}
+
+func intersectSorted(a, b []string) []string {
+	var out []string
+	for i, j := 0, 0; i < len(a) && j < len(b); {
+		switch {
+		case a[i] < b[j]:
+			i++
+		case a[i] > b[j]:
+			j++
+		default:
+			out = append(out, a[i])
+			i++
+			j++
+		}
+	}
+	return out
+}
+
+// snippet returns the text around the first occurrence of term.
+func snippet(text, term string) string {
+	const context = 60
+	runes := []rune(text)
+	lower := strings.ToLower(text)
+	at := strings.Index(lower, term)
+	if at < 0 || len(lower) != len(text) {
+		return string(runes[:min(len(runes), 2*context)])
+	}
+	i := utf8.RuneCountInString(text[:at])
+	start, end := max(0, i-context), min(len(runes), i+utf8.RuneCountInString(term)+context)
+	out := string(runes[start:end])
+	if start > 0 {
+		out = "…" + out
+	}
+	if end < len(runes) {
+		out += "…"
+	}
+	return out
+}
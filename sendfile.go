@@ -0,0 +1,43 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"os"
+)
+
+// streamPlain writes a file that didn't fit in memory from disk, reporting
+// false to leave it to http.ServeContent if it changed size since it was
+// loaded, which would make its prebuilt headers wrong.
+func (s *server) streamPlain(w http.ResponseWriter, r *http.Request, cached *fileCache) bool {
+	f, err := os.Open(cached.file)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	if info, err := f.Stat(); err != nil || info.Size() != cached.size {
+		return false
+	}
+	writePlainHeaders(w, cached)
+	w.WriteHeader(http.StatusOK)
+	if r.Method != http.MethodHead {
+		if err := s.copyFile(w, r, f); err != nil {
+			errorf("streaming %s %v", cached.file, err)
+		}
+	}
+	return true
+}
+
+// copyFile copies f to the response. Over plain HTTP/1 the *os.File reaches
+// the connection's ReadFrom, which uses sendfile. Otherwise the bytes have
+// to pass through user space, in a -copy-buffer sized buffer.
+func (s *server) copyFile(w http.ResponseWriter, r *http.Request, f *os.File) error {
+	if r.TLS == nil && r.ProtoMajor == 1 {
+		_, err := io.Copy(w, f)
+		return err
+	}
+	buf := s.copyBuffers.Get().(*[]byte)
+	defer s.copyBuffers.Put(buf)
+	_, err := io.CopyBuffer(struct{ io.Writer }{w}, struct{ io.Reader }{f}, *buf)
+	return err
+}
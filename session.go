@@ -0,0 +1,112 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// signValue returns value with its expiry and an HMAC of both with the first
+// of keys appended, so it can be handed to the client in a cookie and trusted
+// when it comes back.
+func signValue(keys [][]byte, value string, expiry time.Time) string {
+	payload := base64.RawURLEncoding.EncodeToString([]byte(value)) + "." + strconv.FormatInt(expiry.Unix(), 10)
+	return payload + "." + base64.RawURLEncoding.EncodeToString(valueMAC(keys[0], payload))
+}
+
+// verifyValue returns the value signed by signValue with any of keys, so that
+// values signed with a key being rotated out stay valid, if it hasn't
+// expired.
+func verifyValue(keys [][]byte, signed string) (string, bool) {
+	i := strings.LastIndexByte(signed, '.')
+	if i < 0 {
+		return "", false
+	}
+	payload := signed[:i]
+	mac, err := base64.RawURLEncoding.DecodeString(signed[i+1:])
+	if err != nil || !slices.ContainsFunc(keys, func(key []byte) bool {
+		return hmac.Equal(mac, valueMAC(key, payload))
+	}) {
+		return "", false
+	}
+	encoded, expiry, _ := strings.Cut(payload, ".")
+	unix, err := strconv.ParseInt(expiry, 10, 64)
+	if err != nil || time.Now().Unix() >= unix {
+		return "", false
+	}
+	value, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", false
+	}
+	return string(value), true
+}
+
+func valueMAC(key []byte, payload string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)
+}
+
+// siteSessionKeys derives the session keys of the server for dir from
+// keys, so that a session issued for one site isn't accepted by another
+// sharing FASTSERVE_SESSION_KEYS.
+func siteSessionKeys(keys [][]byte, dir string) [][]byte {
+	derived := make([][]byte, len(keys))
+	for i, key := range keys {
+		derived[i] = valueMAC(key, dir)
+	}
+	return derived
+}
+
+const sessionCookie = "fastserve_session"
+
+// sessionCookieName is the name of the session cookie for scope, one per
+// scope so that sessions for different auth rules don't replace each other.
+func sessionCookieName(scope string) string {
+	return sessionCookie + "_" + base64.RawURLEncoding.EncodeToString([]byte(scope))
+}
+
+// setSession issues the session cookie for subject, who just authenticated
+// for scope, such as an auth rule, so they aren't asked to again for it until
+// the session expires.
+func (s *server) setSession(w http.ResponseWriter, r *http.Request, scope, subject string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName(scope),
+		Value:    signValue(s.sessionKeys, scope+" "+subject, time.Now().Add(s.sessionTTL)),
+		Path:     "/",
+		MaxAge:   int(s.sessionTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   s.requestScheme(r) == "https",
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// session returns the subject of r's session cookie, if it has a valid one
+// for scope.
+func (s *server) session(r *http.Request, scope string) (string, bool) {
+	c, err := r.Cookie(sessionCookieName(scope))
+	if err != nil {
+		return "", false
+	}
+	value, ok := verifyValue(s.sessionKeys, c.Value)
+	if !ok {
+		return "", false
+	}
+	sessionScope, subject, _ := strings.Cut(value, " ")
+	return subject, sessionScope == scope
+}
+
+// handleLogout ends the sessions of every scope.
+func (s *server) handleLogout(w http.ResponseWriter, r *http.Request) {
+	for _, c := range r.Cookies() {
+		if strings.HasPrefix(c.Name, sessionCookie) {
+			http.SetCookie(w, &http.Cookie{Name: c.Name, Path: "/", MaxAge: -1})
+		}
+	}
+	http.Redirect(w, r, "/", http.StatusFound)
+}
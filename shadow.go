@@ -0,0 +1,48 @@
+package main
+
+import (
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// shadowRequests mirrors s.shadowPercent of requests, with their method, path
+// and headers, to s.shadowURL in the background and discards the answers.
+// Mirrored requests beyond a hundred in flight are dropped rather than queued,
+// so a slow shadow can't hold up serving.
+func (s *server) shadowRequests(next http.HandlerFunc) http.HandlerFunc {
+	if s.shadowURL == "" {
+		return next
+	}
+	base := strings.TrimSuffix(s.shadowURL, "/")
+	inFlight := make(chan struct{}, 100)
+	client := &http.Client{Timeout: 30 * time.Second}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if rand.Float64()*100 < s.shadowPercent && r.ContentLength <= 0 {
+			select {
+			case inFlight <- struct{}{}:
+				req, err := http.NewRequest(r.Method, base+r.URL.RequestURI(), nil)
+				if err != nil {
+					<-inFlight
+					break
+				}
+				req.Header = r.Header.Clone()
+				req.Host = r.Host
+				go func() {
+					defer func() { <-inFlight }()
+					resp, err := client.Do(req)
+					if err != nil {
+						errorf("shadowing %v", err)
+						return
+					}
+					io.Copy(io.Discard, resp.Body)
+					resp.Body.Close()
+				}()
+			default:
+			}
+		}
+		next.ServeHTTP(w, r)
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// site is a directory served, with its own certificate if given, for
+// requests to a host other than the default one, or on a listener of its
+// own at addr.
+type site struct {
+	host              string
+	dir               string
+	certFile, keyFile string
+	addr              string
+
+	// The site is refreshed on its own, with its own ignore pattern, until
+	// stop is closed.
+	ignore                 regexp.Regexp
+	refresh, refreshJitter time.Duration
+	watch                  bool
+	watchPoll              time.Duration
+	maintenanceFile        string
+	stop                   chan struct{}
+
+	srv     *server
+	certs   *certLoader
+	handler http.HandlerFunc
+	// layers are the site's own middleware configured per site, by name,
+	// which requests for its host pass through on -addr.
+	layers map[string]http.Handler
+	own    http.Handler
+}
+
+// parseSite parses a host=dir[,cert,key] site.
+func parseSite(spec string) (site, error) {
+	host, rest, ok := strings.Cut(spec, "=")
+	if !ok || host == "" || rest == "" {
+		return site{}, fmt.Errorf("site %q isn't host=dir[,cert,key]", spec)
+	}
+	st := site{host: strings.ToLower(host)}
+	parts := strings.Split(rest, ",")
+	switch len(parts) {
+	case 1:
+	case 3:
+		st.certFile, st.keyFile = parts[1], parts[2]
+	default:
+		return site{}, fmt.Errorf("site %q isn't host=dir[,cert,key]", spec)
+	}
+	st.dir = parts[0]
+	return st, nil
+}
+
+// requestHost returns the host r is for, without the port.
+func requestHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host = r.Host
+	}
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+// siteList holds the sites served next to the main one, replaced as a whole
+// when the -config file is reloaded.
+type siteList struct {
+	current atomic.Pointer[siteSet]
+	// inner is what each middleware configured per site wraps in the main
+	// server's chain, set as it's built, before any site is prepared.
+	inner map[string]http.Handler
+}
+
+// setInner records the handler the main server's middleware of the given
+// name wraps, for the sites to wrap in their own.
+func (l *siteList) setInner(name string, next http.Handler) {
+	if l.inner == nil {
+		l.inner = make(map[string]http.Handler)
+	}
+	l.inner[name] = next
+}
+
+type siteSet struct {
+	sites  []site
+	byHost map[string]*site
+}
+
+func (l *siteList) store(sites []site) {
+	set := &siteSet{sites: sites, byHost: make(map[string]*site)}
+	for i := range set.sites {
+		if host := set.sites[i].host; host != "" {
+			set.byHost[host] = &set.sites[i]
+		}
+	}
+	l.current.Store(set)
+}
+
+func (l *siteList) load() []site {
+	if set := l.current.Load(); set != nil {
+		return set.sites
+	}
+	return nil
+}
+
+// lookup returns the site served for host, or nil.
+func (l *siteList) lookup(host string) *site {
+	if set := l.current.Load(); set != nil {
+		return set.byHost[host]
+	}
+	return nil
+}
+
+// prepare builds the handlers of the site: the one for its host on -addr,
+// whose own limits hold within those of the main server, with its own
+// middleware configured per site wrapping the main server's chain where
+// the main server's would, and the one for its own listener, with the
+// built-in middleware in order.
+func (st *site) prepare(order string, sites *siteList) error {
+	st.handler = st.srv.limitConcurrency(st.srv.limitBandwidth(st.srv.handler().ServeHTTP))
+	st.layers = make(map[string]http.Handler)
+	configured := st.srv.configuredMiddleware()
+	for _, name := range defaultMiddleware {
+		if _, ok := sites.inner[name]; configured[name] && siteMiddleware[name] && !ok {
+			return fmt.Errorf("-middleware leaves out %s, which the flags of site %s use", name, st.host)
+		}
+	}
+	for name, next := range sites.inner {
+		mw, err := st.srv.builtinMiddleware(name, nil)
+		if err != nil {
+			return err
+		}
+		st.layers[name] = mw(next)
+	}
+	if st.addr == "" {
+		return nil
+	}
+	own, err := st.srv.chain(order, new(siteList), st.srv.handler())
+	if err != nil {
+		return err
+	}
+	st.own = logRequest(st.srv.maintenanceMode(new(siteList), own.ServeHTTP))
+	return nil
+}
+
+// siteHandler returns the handler serving each site for its host, and srv
+// for any other host.
+func siteHandler(srv *server, sites *siteList) http.HandlerFunc {
+	fallback := srv.handler().ServeHTTP
+	return func(w http.ResponseWriter, r *http.Request) {
+		if st := sites.lookup(requestHost(r)); st != nil {
+			st.handler(w, r)
+			return
+		}
+		fallback(w, r)
+	}
+}
+
+// siteCertificate returns the tls.Config.GetCertificate choosing the
+// certificate of the site named through SNI, or certs for any other name or
+// a site without its own.
+func siteCertificate(certs *certLoader, sites *siteList) func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+		if st := sites.lookup(name); st != nil && st.certs != nil {
+			return st.certs.getCertificate(hello)
+		}
+		return certs.getCertificate(hello)
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// handler returns the handler serving the cached files and the server's own
+// endpoints under /_/. Files are only served for GET and HEAD; a module
+// answering other methods registers its own method pattern here and adds it
+// to methods, and the mux answers any remaining method with 405 and an Allow
+// header listing them.
+func (s *server) handler() http.Handler {
+	mux := http.NewServeMux()
+	methods := []string{http.MethodGet, http.MethodHead, http.MethodOptions}
+	mux.HandleFunc("GET /", s.handleRequest)
+	mux.HandleFunc("GET /_/status", s.handleStatus)
+	mux.HandleFunc("GET /_/ready", s.handleReady)
+	if s.search {
+		mux.HandleFunc("GET /_/search", s.handleSearch)
+	}
+	if s.serveChecksums {
+		mux.HandleFunc("GET /_/manifest", s.handleChecksums)
+	}
+	if s.feedPath != "" {
+		mux.HandleFunc("GET "+s.feedPath, s.handleFeed)
+	}
+	if s.publicFiles {
+		mux.HandleFunc("GET /_/files", s.handleFiles)
+		mux.HandleFunc("GET /_/changes", s.handleChanges)
+		mux.HandleFunc("GET /_/events", s.handleEvents)
+		mux.HandleFunc("GET /_/ws", s.handleWebSocket)
+		mux.HandleFunc("GET /_/links", s.handleLinks)
+		mux.HandleFunc("GET /_/problems", s.handleProblems)
+	}
+	if s.oidc != nil || len(s.authRules) > 0 {
+		mux.HandleFunc("GET /_/logout", s.handleLogout)
+	}
+	if s.webdav {
+		mux.HandleFunc("PROPFIND /", s.handlePropfind)
+		methods = append(methods, "PROPFIND")
+	}
+
+	options := s.handleOptions(strings.Join(methods, ", "))
+	mux.HandleFunc("OPTIONS /", options)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodOptions && r.RequestURI == "*" {
+			options(w, r)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// adminHandler returns the handler for the admin endpoints, which are only
+// served on -admin-addr.
+func (s *server) adminHandler(sites *siteList) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /admin/maintenance", s.handleMaintenance(sites))
+	mux.HandleFunc("GET /_/files", s.handleFiles)
+	mux.HandleFunc("GET /_/changes", s.handleChanges)
+	mux.HandleFunc("GET /_/events", s.handleEvents)
+	mux.HandleFunc("GET /_/ws", s.handleWebSocket)
+	mux.HandleFunc("GET /_/links", s.handleLinks)
+	mux.HandleFunc("GET /_/problems", s.handleProblems)
+	if s.downloadCounts != nil {
+		mux.HandleFunc("GET /admin/downloads", s.handleDownloadCounts)
+	}
+	return trustRequests(mux)
+}
+
+type status struct {
+	Files    int    `json:"files"`
+	Skipped  int    `json:"skipped"`
+	Version  int    `json:"version"`
+	NotFound int64  `json:"notFound"`
+	Shed     int64  `json:"shed"`
+	Commit   string `json:"commit,omitempty"`
+
+	// CachedBytes is the file content held in memory, and Overflowed the
+	// files served from disk because they didn't fit under -max-memory.
+	CachedBytes int64 `json:"cachedBytes"`
+	Overflowed  int   `json:"overflowed"`
+	// SharedBytes is the content not held again for files identical to
+	// others.
+	SharedBytes int64 `json:"sharedBytes"`
+
+	// BrokenLinks counts the internal links found broken by -check-links.
+	BrokenLinks int `json:"brokenLinks"`
+	// Problems counts the files the last load left out, listed at
+	// /_/problems.
+	Problems int `json:"problems"`
+
+	Refresh refreshStats `json:"refresh"`
+}
+
+func (s *server) handleStatus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.status())
+}
+
+func (s *server) status() status {
+	s.mu.RLock()
+	st := status{Files: s.cache.len(), Skipped: s.skipped, Version: s.version, Refresh: s.refreshStats,
+		CachedBytes: s.cachedBytes, Overflowed: s.overflowed, SharedBytes: s.sharedBytes, BrokenLinks: len(s.brokenLinks),
+		Problems: len(s.problems)}
+	s.mu.RUnlock()
+	st.NotFound = s.notFoundTotal.Load()
+	st.Shed = s.shedTotal.Load()
+	if git, ok := s.backend.(*gitClient); ok {
+		st.Commit = git.revision()
+	}
+	return st
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// walk calls fn for every file under the root. With followSymlinks set,
+// symlinked directories are descended into as long as they resolve inside
+// s.dir or one of the allowed symlink roots, and loops are skipped.
+func (s *server) walk(fn filepath.WalkFunc) error {
+	top := s.root()
+	if !s.followSymlinks {
+		return filepath.Walk(top, fn)
+	}
+
+	real, err := filepath.EvalSymlinks(top)
+	if err != nil {
+		return fn(top, nil, err)
+	}
+	allowed := []string{real}
+	if s.file != "" {
+		allowed[0] = filepath.Dir(real)
+	}
+	for _, dir := range s.symlinkRoots {
+		dir, err := filepath.EvalSymlinks(dir)
+		if err != nil {
+			return err
+		}
+		allowed = append(allowed, dir)
+	}
+
+	info, err := os.Stat(real)
+	if err != nil {
+		return fn(top, nil, err)
+	}
+	w := &symlinkWalker{fn: fn, allowed: allowed, ancestors: make(map[string]bool)}
+	return w.walk(top, real, info)
+}
+
+type symlinkWalker struct {
+	fn        filepath.WalkFunc
+	allowed   []string
+	ancestors map[string]bool
+}
+
+func (w *symlinkWalker) walk(path, real string, info os.FileInfo) error {
+	if err := w.fn(path, info, nil); err != nil || !info.IsDir() {
+		if err == filepath.SkipDir {
+			return nil
+		}
+		return err
+	}
+
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return w.fn(path, info, err)
+	}
+
+	w.ancestors[real] = true
+	defer delete(w.ancestors, real)
+
+	for _, entry := range entries {
+		childPath := filepath.Join(path, entry.Name())
+		childReal := filepath.Join(real, entry.Name())
+		info, err := os.Lstat(childPath)
+		if err != nil {
+			if err := w.fn(childPath, nil, err); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if info.Mode()&os.ModeSymlink != 0 {
+			if childReal, err = filepath.EvalSymlinks(childPath); err == nil {
+				info, err = os.Stat(childReal)
+			}
+			if err != nil {
+				if err := w.fn(childPath, nil, err); err != nil {
+					return err
+				}
+				continue
+			}
+			if !w.inside(childReal) {
+				err = errSymlinkOutside
+			} else if w.ancestors[childReal] {
+				err = errSymlinkLoop
+			}
+			if err != nil {
+				if err := w.fn(childPath, nil, &os.PathError{Op: "follow", Path: childPath, Err: err}); err != nil {
+					return err
+				}
+				continue
+			}
+		}
+
+		if err := w.walk(childPath, childReal, info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *symlinkWalker) inside(real string) bool {
+	for _, dir := range w.allowed {
+		rel, err := filepath.Rel(dir, real)
+		if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
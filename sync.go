@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// syncDir updates s.dir from s.syncFrom before a refresh. An http(s) URL
+// names a JSON manifest like -manifest takes, whose files are downloaded
+// with If-Modified-Since and the files it doesn't list deleted, anything
+// else is an rsync source mirrored with --delete.
+func (s *server) syncDir() error {
+	if strings.HasPrefix(s.syncFrom, "http://") || strings.HasPrefix(s.syncFrom, "https://") {
+		return s.syncHTTP()
+	}
+	cmd := exec.Command("rsync", "-a", "--delete", strings.TrimSuffix(s.syncFrom, "/")+"/", s.dir+"/")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("rsync: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+func (s *server) syncHTTP() error {
+	body, err := httpGet(s.syncFrom)
+	if err != nil {
+		return err
+	}
+	var entries []manifestEntry
+	if err := json.Unmarshal(body, &entries); err != nil {
+		return fmt.Errorf("%s: %w", s.syncFrom, err)
+	}
+	base, _ := url.Parse(s.syncFrom)
+	listed := make(map[string]bool)
+	for _, entry := range entries {
+		ref, err := url.Parse(entry.URL)
+		if err != nil {
+			return fmt.Errorf("%s: %w", s.syncFrom, err)
+		}
+		rel := path.Clean("/" + entry.Path)[1:]
+		if rel == "" {
+			continue
+		}
+		name := filepath.Join(s.dir, filepath.FromSlash(rel))
+		listed[name] = true
+		if err := syncFile(base.ResolveReference(ref).String(), name); err != nil {
+			errorf("sync: %v", err)
+		}
+	}
+	return deleteUnlisted(s.dir, listed)
+}
+
+// deleteUnlisted removes the files under dir that aren't listed, and the
+// directories left empty, as rsync --delete does.
+func deleteUnlisted(dir string, listed map[string]bool) error {
+	var dirs []string
+	err := filepath.WalkDir(dir, func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if name != dir {
+				dirs = append(dirs, name)
+			}
+			return nil
+		}
+		if listed[name] {
+			return nil
+		}
+		infof("sync: deleting %s", name)
+		return os.Remove(name)
+	})
+	if err != nil {
+		return fmt.Errorf("sync: %w", err)
+	}
+	// Deepest first, so parents are empty by the time they're tried.
+	for i := len(dirs) - 1; i >= 0; i-- {
+		os.Remove(dirs[i])
+	}
+	return nil
+}
+
+// syncFile downloads u to name unless it hasn't been modified since name
+// was last written, replacing name atomically.
+func syncFile(u, name string) error {
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	if info, err := os.Stat(name); err == nil {
+		req.Header.Set("If-Modified-Since", info.ModTime().UTC().Format(http.TimeFormat))
+	}
+	resp, err := fetchClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified {
+		return nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", u, resp.Status)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(name), ".sync-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, resp.Body); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if modTime, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		os.Chtimes(tmp.Name(), time.Now(), modTime)
+	}
+	infof("synced %s", name)
+	return os.Rename(tmp.Name(), name)
+}
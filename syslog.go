@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A logSink receives the log lines in place of stderr.
+type logSink interface {
+	send(level logLevel, msg string) error
+}
+
+// sink is where log lines go, stderr if nil.
+var sink logSink
+
+// newLogSink returns the sink for a -log-output of syslog or journald.
+// addr is the syslog server, such as udp://logs:514 or tcp://logs:601,
+// empty for the local /dev/log.
+func newLogSink(output, addr string) (logSink, error) {
+	switch output {
+	case "stderr":
+		return nil, nil
+	case "syslog":
+		s := &syslogSink{network: "unixgram", addr: "/dev/log"}
+		if addr != "" {
+			network, rest, ok := strings.Cut(addr, "://")
+			if !ok || network != "udp" && network != "tcp" {
+				return nil, fmt.Errorf("invalid -syslog-addr %q, want udp://host:port or tcp://host:port", addr)
+			}
+			s.network, s.addr = network, rest
+		}
+		s.hostname, _ = os.Hostname()
+		if s.hostname == "" {
+			s.hostname = "-"
+		}
+		return s, s.dial()
+	case "journald":
+		conn, err := net.Dial("unixgram", "/run/systemd/journal/socket")
+		if err != nil {
+			return nil, err
+		}
+		return &journalSink{conn: conn}, nil
+	}
+	return nil, fmt.Errorf("invalid -log-output %q, want stderr, syslog or journald", output)
+}
+
+// syslogSink sends RFC 5424 messages with the daemon facility, framed by
+// octet counting over TCP.
+type syslogSink struct {
+	network, addr string
+	hostname      string
+
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+func (s *syslogSink) dial() error {
+	conn, err := net.Dial(s.network, s.addr)
+	if err != nil && s.network == "unixgram" {
+		conn, err = net.Dial("unix", s.addr)
+	}
+	s.conn = conn
+	return err
+}
+
+func (s *syslogSink) send(level logLevel, msg string) error {
+	const daemon = 3
+	msg = fmt.Sprintf("<%d>1 %s %s fastserve %d - - %s", daemon*8+syslogSeverity(level),
+		time.Now().UTC().Format(time.RFC3339Nano), s.hostname, os.Getpid(), msg)
+	if s.network == "tcp" {
+		msg = strconv.Itoa(len(msg)) + " " + msg
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn != nil {
+		if _, err := s.conn.Write([]byte(msg)); err == nil {
+			return nil
+		}
+		s.conn.Close()
+	}
+	// Reconnect once, as after the server restarted.
+	if err := s.dial(); err != nil {
+		return err
+	}
+	_, err := s.conn.Write([]byte(msg))
+	return err
+}
+
+func syslogSeverity(level logLevel) int {
+	switch level {
+	case levelDebug:
+		return 7
+	case levelInfo:
+		return 6
+	case levelWarn:
+		return 4
+	}
+	return 3
+}
+
+// journalSink sends entries to the systemd journal over its native
+// protocol.
+type journalSink struct {
+	conn net.Conn
+}
+
+func (j *journalSink) send(level logLevel, msg string) error {
+	b := []byte("PRIORITY=" + strconv.Itoa(syslogSeverity(level)) + "\nSYSLOG_IDENTIFIER=fastserve\n")
+	if strings.Contains(msg, "\n") {
+		b = append(b, "MESSAGE\n"...)
+		b = binary.LittleEndian.AppendUint64(b, uint64(len(msg)))
+		b = append(b, msg...)
+		b = append(b, '\n')
+	} else {
+		b = append(b, "MESSAGE="+msg+"\n"...)
+	}
+	_, err := j.conn.Write(b)
+	return err
+}
+
+// sinkWriter is the output of the log package when there's a sink, for the
+// lines of log.Fatal, sent at level.
+type sinkWriter logLevel
+
+func (w sinkWriter) Write(b []byte) (int, error) {
+	emit(logLevel(w), strings.TrimSuffix(string(b), "\n"))
+	return len(b), nil
+}
+
+// emit sends a line to the sink, falling back to stderr if that fails.
+func emit(level logLevel, msg string) {
+	if err := sink.send(level, msg); err != nil {
+		fmt.Fprintf(os.Stderr, "%s %s (logging: %v)\n", time.Now().Format("2006/01/02 15:04:05"), msg, err)
+	}
+}
+
+// useSink sends the log lines to s from now on.
+func useSink(s logSink) {
+	if s == nil {
+		return
+	}
+	sink = s
+	log.SetFlags(0)
+	log.SetOutput(sinkWriter(levelError))
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"io"
+	"maps"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// timeoutGrace is how long past its timeout a request's connection stays
+// writable, for the 503 of a request that timed out before responding.
+const timeoutGrace = time.Second
+
+// limitTime bounds how long a request may take, s.requestTimeout or, for
+// range requests, s.rangeTimeout if set: its context is cancelled and writes
+// to a client still reading the response fail once it passes. A request that
+// times out before anything was written is answered with 503 right away,
+// like http.TimeoutHandler, and what its handler writes after is dropped.
+// The /_/events and /_/ws streams aren't limited.
+func (s *server) limitTime(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		d := s.requestTimeout
+		if r.Header.Get("Range") != "" && s.rangeTimeout != 0 {
+			d = s.rangeTimeout
+		}
+		if d == 0 || r.URL.Path == "/_/events" || r.URL.Path == "/_/ws" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), d)
+		defer cancel()
+		// Overrides the server's WriteTimeout for this request.
+		http.NewResponseController(w).SetWriteDeadline(time.Now().Add(d + timeoutGrace))
+		tw := &timeoutWriter{ResponseWriter: w, header: w.Header().Clone()}
+		timer := time.AfterFunc(d, tw.timeout)
+		next.ServeHTTP(tw, r.WithContext(ctx))
+		timer.Stop()
+		tw.finish()
+	}
+}
+
+// timeoutWriter passes a response through unless it times out before
+// being started, answering 503 then. The handler sets headers on a copy
+// until it starts, as the 503 may be sent meanwhile.
+type timeoutWriter struct {
+	http.ResponseWriter
+	header   http.Header
+	mu       sync.Mutex
+	wrote    bool
+	timedOut bool
+	finished bool
+}
+
+// timeout sends the 503 of a response not started yet.
+func (w *timeoutWriter) timeout() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.wrote || w.finished {
+		return
+	}
+	w.timedOut = true
+	http.Error(w.ResponseWriter, "request timed out", http.StatusServiceUnavailable)
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+// finish keeps a timeout that fires as the handler returns from writing
+// after it, waiting for one already writing.
+func (w *timeoutWriter) finish() {
+	w.mu.Lock()
+	w.finished = true
+	w.mu.Unlock()
+}
+
+// start marks the response started, reporting false if it timed out first.
+// Once started the timer no longer writes, so the response needs no lock.
+func (w *timeoutWriter) start() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.timedOut {
+		return false
+	}
+	if !w.wrote {
+		w.wrote = true
+		h := w.ResponseWriter.Header()
+		clear(h)
+		maps.Copy(h, w.header)
+	}
+	return true
+}
+
+func (w *timeoutWriter) Header() http.Header {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.wrote {
+		return w.ResponseWriter.Header()
+	}
+	return w.header
+}
+
+func (w *timeoutWriter) WriteHeader(code int) {
+	if w.start() {
+		w.ResponseWriter.WriteHeader(code)
+	}
+}
+
+func (w *timeoutWriter) Write(b []byte) (int, error) {
+	if !w.start() {
+		return 0, http.ErrHandlerTimeout
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// ReadFrom passes files through to the connection, keeping sendfile.
+func (w *timeoutWriter) ReadFrom(src io.Reader) (int64, error) {
+	if !w.start() {
+		return 0, http.ErrHandlerTimeout
+	}
+	return io.Copy(w.ResponseWriter, src)
+}
+
+func (w *timeoutWriter) Flush() {
+	if w.start() {
+		http.NewResponseController(w.ResponseWriter).Flush()
+	}
+}
+
+func (w *timeoutWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
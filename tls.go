@@ -0,0 +1,158 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+var tlsCurves = map[string]tls.CurveID{
+	"X25519":         tls.X25519,
+	"X25519MLKEM768": tls.X25519MLKEM768,
+	"P256":           tls.CurveP256,
+	"P384":           tls.CurveP384,
+	"P521":           tls.CurveP521,
+}
+
+// tlsConfig returns the TLS configuration for the given minimum version, such
+// as 1.2, and comma-separated cipher suite and curve names, which are left to
+// Go's defaults if empty. Cipher suites only apply up to TLS 1.2.
+func tlsConfig(minVersion, ciphers, curves string) (*tls.Config, error) {
+	version, ok := tlsVersions[minVersion]
+	if !ok {
+		return nil, fmt.Errorf("unknown TLS version %q", minVersion)
+	}
+	config := &tls.Config{MinVersion: version}
+
+	suites := make(map[string]uint16)
+	for _, suite := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		suites[suite.Name] = suite.ID
+	}
+	for _, name := range splitList(ciphers) {
+		id, ok := suites[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown cipher suite %q", name)
+		}
+		config.CipherSuites = append(config.CipherSuites, id)
+	}
+
+	for _, name := range splitList(curves) {
+		id, ok := tlsCurves[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown curve %q", name)
+		}
+		config.CurvePreferences = append(config.CurvePreferences, id)
+	}
+	return config, nil
+}
+
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// certLoader holds the certificate loaded from a certificate and key file,
+// reloading it when either file changes or on SIGHUP, so renewed
+// certificates are picked up without a restart.
+type certLoader struct {
+	certFile, keyFile string
+	ocsp              bool
+
+	cert         atomic.Pointer[tls.Certificate]
+	modTimes     [2]time.Time
+	nextStaple   time.Time
+	stapleExpiry time.Time
+}
+
+func newCertLoader(certFile, keyFile string, ocsp bool) (*certLoader, error) {
+	c := &certLoader{certFile: certFile, keyFile: keyFile, ocsp: ocsp}
+	c.modTimes = c.stat()
+	return c, c.load()
+}
+
+func (c *certLoader) load() error {
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+	if c.ocsp {
+		c.stapleExpiry = time.Time{}
+		if err := c.staple(&cert); err != nil {
+			errorf("stapling OCSP response: %v", err)
+		}
+	}
+	c.cert.Store(&cert)
+	return nil
+}
+
+func (c *certLoader) stat() [2]time.Time {
+	var modTimes [2]time.Time
+	for i, name := range []string{c.certFile, c.keyFile} {
+		if info, err := os.Stat(name); err == nil {
+			modTimes[i] = info.ModTime()
+		}
+	}
+	return modTimes
+}
+
+func (c *certLoader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return c.cert.Load(), nil
+}
+
+// watch polls the files for changes and listens for SIGHUP, and refreshes
+// the OCSP staple when it's due. A certificate that fails to load, such as
+// while only one of the files was replaced yet, is logged and the previous
+// one kept. It returns once stop is closed.
+func (c *certLoader) watch(stop <-chan struct{}) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	ticker := time.NewTicker(10 * time.Second)
+	defer ticker.Stop()
+	for {
+		var restaple <-chan time.Time
+		if c.ocsp {
+			restaple = time.After(time.Until(c.nextStaple))
+		}
+		select {
+		case <-stop:
+			return
+		case <-hup:
+		case <-ticker.C:
+			modTimes := c.stat()
+			if modTimes == c.modTimes {
+				continue
+			}
+			c.modTimes = modTimes
+		case <-restaple:
+			cert := *c.cert.Load()
+			if err := c.staple(&cert); err != nil {
+				errorf("stapling OCSP response: %v", err)
+			}
+			c.cert.Store(&cert)
+			continue
+		}
+		if err := c.load(); err != nil {
+			errorf("reloading certificate: %v", err)
+			continue
+		}
+		infof("reloaded certificate %s", c.certFile)
+	}
+}
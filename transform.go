@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// transformer changes a file's content as it's cached. It returns the new
+// content and metadata about it; a content-type entry overrides the detected
+// type, as for a transformer rendering another format to HTML. applies
+// reports whether it may change a file, which is then held in memory.
+type transformer interface {
+	transform(relPath string, content []byte) ([]byte, map[string]string, error)
+	applies(relPath string) bool
+}
+
+// builtinTransformer returns the built-in transformer with the given name.
+func (s *server) builtinTransformer(name string) (transformer, error) {
+	switch name {
+	case "script":
+		return scriptTransformer{s}, nil
+	case "inject":
+		return injector{s}, nil
+	case "minify-css":
+		return cssMinifier{}, nil
+	case "canonical":
+		return canonicalLinker{s}, nil
+	}
+	return nil, fmt.Errorf("unknown transform %q, want script, inject, canonical or minify-css", name)
+}
+
+// transform passes content through s.transformers in order. A transformer
+// that fails is logged and skipped.
+func (s *server) transform(relPath string, content []byte) ([]byte, map[string]string) {
+	var meta map[string]string
+	for _, t := range s.transformers {
+		out, m, err := t.transform(relPath, content)
+		if err != nil {
+			errorf("transforming %s: %v", relPath, err)
+			continue
+		}
+		content = out
+		for k, v := range m {
+			if meta == nil {
+				meta = make(map[string]string)
+			}
+			meta[k] = v
+		}
+	}
+	return content, meta
+}
+
+// processed reports whether a file may be changed as it's cached, by a
+// transformer or by stamping nonces into it under -csp. Such files are held
+// in memory even beyond -max-memory, as streaming them from disk would serve
+// them unchanged, without their nonces and Content-Security-Policy.
+func (s *server) processed(relPath string) bool {
+	if s.csp != "" && isHTML(relPath) {
+		return true
+	}
+	for _, t := range s.transformers {
+		if t.applies(relPath) {
+			return true
+		}
+	}
+	return false
+}
+
+// scriptTransformer runs the -script on_refresh hook.
+type scriptTransformer struct{ s *server }
+
+func (t scriptTransformer) transform(relPath string, content []byte) ([]byte, map[string]string, error) {
+	return t.s.script.transform(relPath, content), nil, nil
+}
+
+func (t scriptTransformer) applies(string) bool {
+	return t.s.script != nil && t.s.script.onRefresh != nil
+}
+
+// cssMinifier strips comments and collapses whitespace in CSS files.
+type cssMinifier struct{}
+
+var (
+	cssComment = regexp.MustCompile(`(?s)/\*.*?\*/`)
+	cssSpace   = regexp.MustCompile(`\s+`)
+	// The space before a colon in a selector is a descendant combinator,
+	// as in a :hover, so it's only removed in declarations.
+	cssSelectorSpace    = regexp.MustCompile(`\s*([,>])\s*`)
+	cssDeclarationSpace = regexp.MustCompile(`\s*([:,])\s*`)
+)
+
+func (cssMinifier) applies(relPath string) bool {
+	return strings.ToLower(filepath.Ext(relPath)) == ".css"
+}
+
+func (cssMinifier) transform(relPath string, content []byte) ([]byte, map[string]string, error) {
+	if strings.ToLower(filepath.Ext(relPath)) != ".css" {
+		return content, nil, nil
+	}
+	// Leave stylesheets with string literals alone rather than risk
+	// changing what they contain.
+	if strings.ContainsAny(string(content), `"'`) {
+		return content, nil, nil
+	}
+	out := cssComment.ReplaceAll(content, nil)
+	out = cssSpace.ReplaceAll(out, []byte(" "))
+	// Each part up to a brace or semicolon is a selector or at-rule
+	// prelude if a block follows it, and a declaration otherwise.
+	var b strings.Builder
+	for rest := string(out); rest != ""; {
+		part, delim := rest, ""
+		if i := strings.IndexAny(rest, "{};"); i >= 0 {
+			part, delim, rest = rest[:i], rest[i:i+1], rest[i+1:]
+		} else {
+			rest = ""
+		}
+		part = strings.TrimSpace(part)
+		if delim == "{" {
+			b.WriteString(cssSelectorSpace.ReplaceAllString(part, "$1"))
+		} else {
+			b.WriteString(cssDeclarationSpace.ReplaceAllString(part, "$1"))
+		}
+		b.WriteString(delim)
+	}
+	return []byte(strings.ReplaceAll(b.String(), ";}", "}")), nil, nil
+}
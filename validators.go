@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// validatorRule chooses the validators sent and honored for matching paths,
+// as some CDNs mishandle ETags or Last-Modified.
+type validatorRule struct {
+	pattern      *regexp.Regexp
+	etag         bool
+	weak         bool
+	lastModified bool
+}
+
+// parseValidatorRules parses pattern=validators rules, such as
+// /api/*=weak-etag or *.html=last-modified, where validators is a
+// comma-separated list of etag, weak-etag and last-modified, or none.
+func parseValidatorRules(rules []string) ([]validatorRule, error) {
+	var parsed []validatorRule
+	for _, rule := range rules {
+		pattern, list, ok := strings.Cut(rule, "=")
+		if !ok || list == "" {
+			return nil, fmt.Errorf("invalid validator rule %q", rule)
+		}
+		re, err := compileGlob(pattern)
+		if err != nil {
+			return nil, err
+		}
+		v := validatorRule{pattern: re}
+		for _, name := range splitList(list) {
+			switch name {
+			case "etag":
+				v.etag = true
+			case "weak-etag":
+				v.etag, v.weak = true, true
+			case "last-modified":
+				v.lastModified = true
+			case "none":
+			default:
+				return nil, fmt.Errorf("invalid validator %q in rule %q", name, rule)
+			}
+		}
+		parsed = append(parsed, v)
+	}
+	return parsed, nil
+}
+
+// validators returns the rule for a path, which is a strong ETag and
+// Last-Modified unless a -validators rule matches.
+func (s *server) validators(path string) validatorRule {
+	for _, rule := range s.validatorRules {
+		if rule.pattern.MatchString(path) {
+			return rule
+		}
+	}
+	return validatorRule{etag: true, lastModified: true}
+}
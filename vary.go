@@ -0,0 +1,24 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// varyOn records that the response was chosen by the named request header,
+// such as Accept-Language, in a single Vary header listing each header once.
+// Every content negotiation goes through it so caches are told exactly the
+// dimensions a response depends on, however many of them applied.
+func varyOn(h http.Header, name string) {
+	var names []string
+	for _, value := range h.Values("Vary") {
+		for _, field := range strings.Split(value, ",") {
+			if field = strings.TrimSpace(field); field == "*" || strings.EqualFold(field, name) {
+				return
+			} else if field != "" {
+				names = append(names, field)
+			}
+		}
+	}
+	h.Set("Vary", strings.Join(append(names, name), ", "))
+}
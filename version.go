@@ -0,0 +1,99 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+type snapshot struct {
+	id    int
+	cache *fileIndex
+	// sidecars are those indexed for cache, so that a file served from
+	// the snapshot keeps the metadata it had then.
+	sidecars map[string]*fileMeta
+}
+
+// recordVersion starts a new content version if next differs from the
+// current cache, keeping the last s.keepVersions snapshots addressable under
+// /_v/<id>/. It must be called with s.mu held.
+func (s *server) recordVersion(next *fileIndex) {
+	changed := next.len() != s.cache.len() || s.version == 0
+	for path, entry := range next.all() {
+		if changed {
+			break
+		}
+		changed = s.cache.get(path) != entry
+	}
+	if !changed {
+		return
+	}
+
+	s.version++
+	if s.keepVersions == 0 {
+		return
+	}
+	s.snapshots = append(s.snapshots, snapshot{id: s.version, cache: next})
+	if len(s.snapshots) > s.keepVersions {
+		s.snapshots = s.snapshots[len(s.snapshots)-s.keepVersions:]
+	}
+}
+
+// keepSidecars records the sidecars just indexed for next with its
+// snapshot, if it was kept. It must be called with s.mu held.
+func (s *server) keepSidecars(next *fileIndex) {
+	if n := len(s.snapshots); n > 0 && s.snapshots[n-1].cache == next {
+		s.snapshots[n-1].sidecars = s.sidecars
+	}
+}
+
+// serveVersion serves p, such as /_v/3/index.html, from the snapshot it
+// names.
+func (s *server) serveVersion(w http.ResponseWriter, r *http.Request, p string) {
+	id, rest, _ := strings.Cut(strings.TrimPrefix(p, "/_v/"), "/")
+	n, err := strconv.Atoi(id)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	if rest == "" || strings.HasSuffix(rest, "/") {
+		rest += "index.html"
+	}
+	rest = norm.NFC.String(rest)
+	if !s.authorizeFile(w, r, rest) {
+		return
+	}
+
+	var cached *fileCache
+	var pre precompressed
+	var meta fileMeta
+	s.mu.RLock()
+	for _, snap := range s.snapshots {
+		if snap.id != n {
+			continue
+		}
+		cached, pre = snap.cache.get(rest), snap.cache.siblings[rest]
+		if cached == nil {
+			break
+		}
+		v := fileView{snap.cache, snap.sidecars}
+		if hidden, _ := v.hidden(rest, cached); hidden {
+			cached = nil
+		} else {
+			meta = v.meta(rest, cached)
+		}
+	}
+	s.mu.RUnlock()
+
+	if cached == nil {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("X-Content-Version", id)
+	if s.serveMeta(w, r, meta) {
+		return
+	}
+	s.serveEntry(w, r, rest, cached, pre)
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"time"
+)
+
+// openSecurityLog opens the log that failed authentication and rate limit
+// violations are appended to, one per line in a stable format meant for
+// fail2ban and the like:
+//
+//	2006-01-02T15:04:05Z rate-limited client=192.0.2.1 path="/index.html"
+func openSecurityLog(name string) (*log.Logger, error) {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return log.New(f, "", 0), nil
+}
+
+// logViolation records event, such as auth-failed, for the client making r.
+func (s *server) logViolation(r *http.Request, event string) {
+	if s.securityLog == nil {
+		return
+	}
+	s.securityLog.Printf("%s %s client=%s path=%q", time.Now().UTC().Format(time.RFC3339), event, s.clientIP(r), r.URL.Path)
+}
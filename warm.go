@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// cdnWarmer requests the changed files from a CDN after a refresh, so its
+// edge caches hold them before visitors ask.
+type cdnWarmer struct {
+	baseURL     string
+	concurrency int
+	client      *http.Client
+}
+
+func newCDNWarmer(baseURL string, concurrency int) *cdnWarmer {
+	return &cdnWarmer{
+		baseURL:     strings.TrimSuffix(baseURL, "/"),
+		concurrency: max(concurrency, 1),
+		client:      &http.Client{Timeout: time.Minute},
+	}
+}
+
+// warm requests the URLs of the added and modified files, at most
+// w.concurrency at once.
+func (w *cdnWarmer) warm(c changeSet) {
+	urls := publicURLs(w.baseURL, c.changed())
+	if len(urls) == 0 {
+		return
+	}
+	start := time.Now()
+	queue := make(chan string)
+	var (
+		mu     sync.Mutex
+		failed int
+		wg     sync.WaitGroup
+	)
+	for range min(w.concurrency, len(urls)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for u := range queue {
+				if err := w.get(u); err != nil {
+					warnf("warm: %v", err)
+					mu.Lock()
+					failed++
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	for _, u := range urls {
+		queue <- u
+	}
+	close(queue)
+	wg.Wait()
+	infof("warmed %d of %d URLs at %s in %v", len(urls)-failed, len(urls), w.baseURL, time.Since(start).Round(time.Millisecond))
+}
+
+// get requests u as a browser would, reading the whole response so the
+// CDN caches it.
+func (w *cdnWarmer) get(u string) error {
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept-Encoding", "gzip, deflate, br")
+	req.Header.Set("User-Agent", "fastserve-warm")
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if _, err := io.Copy(io.Discard, resp.Body); err != nil {
+		return fmt.Errorf("GET %s: %v", u, err)
+	}
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("GET %s: %s", u, resp.Status)
+	}
+	return nil
+}
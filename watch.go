@@ -0,0 +1,166 @@
+package main
+
+import (
+	"errors"
+	"hash/fnv"
+	"io/fs"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// A notifier reports changes in the directories added to it, such as with
+// inotify. add fails for a directory it can't watch, which is then polled
+// with everything under it.
+type notifier interface {
+	add(dir string) error
+	events() <-chan notifyEvent
+	close()
+}
+
+// notifyEvent is a change in a watched directory. newDir is set for a
+// directory created in it, which needs watching too.
+type notifyEvent struct {
+	path   string
+	newDir bool
+}
+
+// errNoNotify is the error of a notifier for a filesystem that doesn't
+// deliver notifications for changes made elsewhere, such as NFS or FUSE.
+var errNoNotify = errors.New("filesystem doesn't support change notifications")
+
+// watchSettle is how long changes have to stop for before the refresh
+// they trigger, as a deploy writes many files in a burst.
+const watchSettle = 200 * time.Millisecond
+
+// dirWatcher refreshes a server as soon as files under its directory
+// change, watching the directories with the notifier where it can and
+// polling the subtrees it can't every poll interval.
+type dirWatcher struct {
+	srv     *server
+	ignore  regexp.Regexp
+	poll    time.Duration
+	native  notifier
+	watched int
+	// polled are the roots of the polled subtrees, by the signature of
+	// their files when last polled.
+	polled map[string]uint64
+}
+
+// watchDir watches the directory of srv with -watch until stop is closed.
+func watchDir(srv *server, ignore regexp.Regexp, poll time.Duration, stop <-chan struct{}) {
+	if srv.archive != "" || srv.fsys != nil || srv.backend != nil {
+		warnf("-watch only watches directories, not watching %s", srv.dir)
+		return
+	}
+	w := &dirWatcher{srv: srv, ignore: ignore, poll: poll, polled: make(map[string]uint64)}
+	var err error
+	if w.native, err = newNotifier(); err != nil {
+		warnf("polling %s every %v: %v", srv.dir, poll, err)
+		w.polled[srv.dir] = w.signature(srv.dir)
+	} else {
+		defer w.native.close()
+		w.addTree(srv.dir)
+		infof("watching %d directories of %s for changes, polling %d subtrees", w.watched, srv.dir, len(w.polled))
+	}
+	w.run(stop)
+}
+
+// addTree watches dir and the directories under it, falling back to
+// polling each subtree that can't be watched.
+func (w *dirWatcher) addTree(dir string) {
+	filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.IsDir() {
+			return nil
+		}
+		if rel, _ := filepath.Rel(w.srv.dir, path); rel != "." && w.ignore.MatchString(filepath.ToSlash(rel)) {
+			return filepath.SkipDir
+		}
+		if err := w.native.add(path); err != nil {
+			if _, polled := w.polled[path]; !polled {
+				warnf("polling %s every %v: %v", path, w.poll, err)
+				w.polled[path] = w.signature(path)
+			}
+			return filepath.SkipDir
+		}
+		w.watched++
+		return nil
+	})
+}
+
+func (w *dirWatcher) run(stop <-chan struct{}) {
+	var events <-chan notifyEvent
+	if w.native != nil {
+		events = w.native.events()
+	}
+	ticker := time.NewTicker(w.poll)
+	defer ticker.Stop()
+	settle := time.NewTimer(0)
+	<-settle.C
+	for {
+		select {
+		case <-stop:
+			settle.Stop()
+			return
+		case e, ok := <-events:
+			if !ok {
+				warnf("watching %s stopped, polling it every %v", w.srv.dir, w.poll)
+				events, w.native = nil, nil
+				clear(w.polled)
+				w.polled[w.srv.dir] = w.signature(w.srv.dir)
+				continue
+			}
+			// After the event queue overflowed, directories created since
+			// may not be watched.
+			if e.path == "" {
+				w.addTree(w.srv.dir)
+			} else if e.newDir {
+				w.addTree(e.path)
+			}
+			debugf("changed %s", e.path)
+			settle.Reset(watchSettle)
+		case <-ticker.C:
+			for dir, sig := range w.polled {
+				if next := w.signature(dir); next != sig {
+					w.polled[dir] = next
+					debugf("changed under %s", dir)
+					settle.Reset(watchSettle)
+				}
+			}
+		case <-settle.C:
+			start := time.Now()
+			if err := w.srv.refresh(w.ignore); err != nil {
+				if err == errRefreshing {
+					settle.Reset(watchSettle)
+				} else {
+					errorf("refreshing %s: %v", w.srv.dir, err)
+				}
+				continue
+			}
+			w.srv.mu.RLock()
+			skipped := w.srv.skipped
+			w.srv.mu.RUnlock()
+			infof("refreshed %s on change in %v, skipped %d files", w.srv.dir, time.Since(start), skipped)
+		}
+	}
+}
+
+// signature hashes the paths, sizes and modification times of the files
+// under dir, so a poll can tell whether any changed.
+func (w *dirWatcher) signature(dir string) uint64 {
+	h := fnv.New64a()
+	filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		h.Write([]byte(path))
+		h.Write([]byte(strconv.FormatInt(info.Size(), 10) + " " + strconv.FormatInt(info.ModTime().UnixNano(), 10) + "\n"))
+		return nil
+	})
+	return h.Sum64()
+}
@@ -0,0 +1,153 @@
+//go:build linux
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const inotifyMask = unix.IN_CREATE | unix.IN_DELETE | unix.IN_MODIFY | unix.IN_CLOSE_WRITE | unix.IN_ATTRIB |
+	unix.IN_MOVED_FROM | unix.IN_MOVED_TO | unix.IN_DELETE_SELF | unix.IN_MOVE_SELF | unix.IN_ONLYDIR
+
+// Filesystems whose changes made on other machines or by a userspace
+// server inotify doesn't see.
+var remoteFilesystems = map[int64]string{
+	0x6969:     "nfs",
+	0x65735546: "fuse",
+	0x517b:     "smb",
+	0xff534d42: "cifs",
+	0xfe534d42: "smb2",
+	0x01021997: "9p",
+	0x00c36400: "ceph",
+}
+
+// inotifyNotifier watches directories with inotify.
+type inotifyNotifier struct {
+	// fd is kept apart from file, as file.Fd would make it blocking.
+	fd   int
+	file *os.File
+	ch   chan notifyEvent
+	// done is closed by close, so that read stops even when nothing takes
+	// the events it's sending.
+	done      chan struct{}
+	closeOnce sync.Once
+
+	mu   sync.Mutex
+	dirs map[int]string
+}
+
+func newNotifier() (notifier, error) {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return nil, fmt.Errorf("inotify: %v", err)
+	}
+	n := &inotifyNotifier{
+		fd:   fd,
+		file: os.NewFile(uintptr(fd), "inotify"),
+		ch:   make(chan notifyEvent, 256),
+		done: make(chan struct{}),
+		dirs: make(map[int]string),
+	}
+	go n.read()
+	return n, nil
+}
+
+func (n *inotifyNotifier) add(dir string) error {
+	var st unix.Statfs_t
+	if err := unix.Statfs(dir, &st); err == nil {
+		if name, ok := remoteFilesystems[int64(st.Type)]; ok {
+			return fmt.Errorf("%w: %s", errNoNotify, name)
+		}
+	}
+	wd, err := unix.InotifyAddWatch(n.fd, dir, inotifyMask)
+	if errors.Is(err, unix.ENOSPC) {
+		return errors.New("inotify watch limit reached, raise fs.inotify.max_user_watches")
+	}
+	if err != nil {
+		return fmt.Errorf("inotify: %v", err)
+	}
+	n.mu.Lock()
+	n.dirs[wd] = dir
+	n.mu.Unlock()
+	return nil
+}
+
+func (n *inotifyNotifier) events() <-chan notifyEvent {
+	return n.ch
+}
+
+// close closes the inotify fd, which removes its watches.
+func (n *inotifyNotifier) close() {
+	n.closeOnce.Do(func() {
+		close(n.done)
+		n.file.Close()
+	})
+}
+
+// send hands e to the watcher, reporting false once the notifier is
+// closed.
+func (n *inotifyNotifier) send(e notifyEvent) bool {
+	select {
+	case n.ch <- e:
+		return true
+	case <-n.done:
+		return false
+	}
+}
+
+// read turns the inotify events into notifyEvents until the file is
+// closed, closing the channel then.
+func (n *inotifyNotifier) read() {
+	defer close(n.ch)
+	buf := make([]byte, 64*1024)
+	for {
+		size, err := n.file.Read(buf)
+		if err != nil {
+			return
+		}
+		for off := 0; off+unix.SizeofInotifyEvent <= size; {
+			e := (*unix.InotifyEvent)(unsafe.Pointer(&buf[off]))
+			name := buf[off+unix.SizeofInotifyEvent : off+unix.SizeofInotifyEvent+int(e.Len)]
+			off += unix.SizeofInotifyEvent + int(e.Len)
+
+			n.mu.Lock()
+			dir := n.dirs[int(e.Wd)]
+			if e.Mask&unix.IN_IGNORED != 0 {
+				delete(n.dirs, int(e.Wd))
+			}
+			n.mu.Unlock()
+			if e.Mask&unix.IN_Q_OVERFLOW != 0 {
+				if !n.send(notifyEvent{}) {
+					return
+				}
+				continue
+			}
+			if dir == "" {
+				continue
+			}
+			path := dir
+			if i := indexNUL(name); i > 0 {
+				path = filepath.Join(dir, string(name[:i]))
+			}
+			if !n.send(notifyEvent{path: path, newDir: e.Mask&unix.IN_ISDIR != 0 && e.Mask&(unix.IN_CREATE|unix.IN_MOVED_TO) != 0}) {
+				return
+			}
+		}
+	}
+}
+
+func indexNUL(b []byte) int {
+	for i, c := range b {
+		if c == 0 {
+			return i
+		}
+	}
+	return len(b)
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+
+package main
+
+import (
+	"fmt"
+	"runtime"
+)
+
+func newNotifier() (notifier, error) {
+	return nil, fmt.Errorf("%w on %s", errNoNotify, runtime.GOOS)
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/xml"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// indexDirs maps every directory to its cached children, with a trailing
+// slash for subdirectories. It must be called with s.mu held.
+func (s *server) indexDirs() {
+	dirs := map[string]map[string]bool{"": {}}
+	for p := range s.cache.all() {
+		dir := ""
+		for {
+			name, rest, ok := strings.Cut(p, "/")
+			if dirs[dir] == nil {
+				dirs[dir] = make(map[string]bool)
+			}
+			if !ok {
+				dirs[dir][name] = true
+				break
+			}
+			dirs[dir][name+"/"] = true
+			dir, p = dir+name+"/", rest
+		}
+	}
+	s.dirs = make(map[string][]string, len(dirs))
+	for dir, children := range dirs {
+		names := make([]string, 0, len(children))
+		for name := range children {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		s.dirs[dir] = names
+	}
+}
+
+type davResponse struct {
+	Href     string   `xml:"D:href"`
+	Propstat davStats `xml:"D:propstat"`
+}
+
+type davStats struct {
+	Prop   davProp `xml:"D:prop"`
+	Status string  `xml:"D:status"`
+}
+
+type davProp struct {
+	DisplayName  string          `xml:"D:displayname"`
+	ResourceType davResourceType `xml:"D:resourcetype"`
+	Length       string          `xml:"D:getcontentlength,omitempty"`
+	LastModified string          `xml:"D:getlastmodified,omitempty"`
+	ContentType  string          `xml:"D:getcontenttype,omitempty"`
+}
+
+type davResourceType struct {
+	Collection *struct{} `xml:"D:collection"`
+}
+
+type davMultistatus struct {
+	XMLName   xml.Name      `xml:"D:multistatus"`
+	Namespace string        `xml:"xmlns:D,attr"`
+	Responses []davResponse `xml:"D:response"`
+}
+
+// handlePropfind answers WebDAV PROPFIND requests for cached files and the
+// directories containing them, so the tree can be mounted read-only.
+func (s *server) handlePropfind(w http.ResponseWriter, r *http.Request) {
+	depth := r.Header.Get("Depth")
+	if depth == "infinity" || depth == "" {
+		http.Error(w, "Depth: infinity is not supported", http.StatusForbidden)
+		return
+	}
+	p, ok := canonicalPath(r.URL.Path)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	rel := strings.TrimPrefix(p, "/")
+
+	ms := davMultistatus{Namespace: "DAV:"}
+	a := s.requestAccess(r)
+	s.mu.RLock()
+	if entry, ok := s.cache.lookup(rel); ok {
+		if hidden, _ := s.hidden(rel, entry); !hidden && a.allows(rel, entry) {
+			ms.Responses = append(ms.Responses, s.davFile(rel, entry))
+		}
+	} else if dir := strings.TrimSuffix(rel, "/") + "/"; s.dirs[strings.TrimPrefix(dir, "/")] != nil {
+		dir = strings.TrimPrefix(dir, "/")
+		ms.Responses = append(ms.Responses, davDir(dir))
+		if depth == "1" {
+			for _, name := range s.dirs[dir] {
+				if strings.HasSuffix(name, "/") {
+					ms.Responses = append(ms.Responses, davDir(dir+name))
+				} else if entry := s.cache.get(dir + name); entry != nil {
+					if hidden, _ := s.hidden(dir+name, entry); !hidden && a.allows(dir+name, entry) {
+						ms.Responses = append(ms.Responses, s.davFile(dir+name, entry))
+					}
+				}
+			}
+		}
+	}
+	s.mu.RUnlock()
+
+	if len(ms.Responses) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.WriteHeader(http.StatusMultiStatus)
+	w.Write([]byte(xml.Header))
+	xml.NewEncoder(w).Encode(ms)
+}
+
+func (s *server) davFile(rel string, entry *fileCache) davResponse {
+	ctype := entry.contentType
+	if ctype == "" {
+		ctype = mimeType(rel, entry.content)
+	}
+	return davResponse{
+		Href: davHref(rel),
+		Propstat: davStats{
+			Prop: davProp{
+				DisplayName:  path.Base(rel),
+				Length:       strconv.FormatInt(entry.size, 10),
+				LastModified: entry.modTime.UTC().Format(http.TimeFormat),
+				ContentType:  ctype,
+			},
+			Status: "HTTP/1.1 200 OK",
+		},
+	}
+}
+
+func davDir(dir string) davResponse {
+	return davResponse{
+		Href: davHref(dir),
+		Propstat: davStats{
+			Prop: davProp{
+				DisplayName:  path.Base("/" + dir),
+				ResourceType: davResourceType{Collection: &struct{}{}},
+			},
+			Status: "HTTP/1.1 200 OK",
+		},
+	}
+}
+
+func davHref(rel string) string {
+	u := url.URL{Path: "/" + rel}
+	return u.EscapedPath()
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+)
+
+// webhookAttempts is how many times a webhook delivery is tried, waiting
+// twice as long after each failure from a second.
+const webhookAttempts = 5
+
+// webhookPayload is the body posted to -webhook URLs after a refresh.
+type webhookPayload struct {
+	Version int       `json:"version"`
+	At      time.Time `json:"at"`
+	changeSet
+}
+
+// webhook posts the changes of every refresh to a URL, signing the body
+// with HMAC-SHA256 under FASTSERVE_WEBHOOK_SECRET, if set, in the
+// X-Fastserve-Signature header as sha256=<hex>.
+type webhook struct {
+	url    string
+	secret []byte
+	client *http.Client
+	// queue holds the bodies to deliver, one at a time in the order of
+	// the refreshes.
+	queue chan []byte
+}
+
+func newWebhook(url string) *webhook {
+	h := &webhook{
+		url:    url,
+		secret: []byte(os.Getenv("FASTSERVE_WEBHOOK_SECRET")),
+		client: &http.Client{Timeout: 30 * time.Second},
+		queue:  make(chan []byte, 64),
+	}
+	go func() {
+		for body := range h.queue {
+			h.deliver(body)
+		}
+	}()
+	return h
+}
+
+// webhookChanges returns a change hook posting the changes to the hooks in
+// the background, leaving out the files an anonymous client may not see.
+func (s *server) webhookChanges(hooks []*webhook) func(changeSet) {
+	return func(c changeSet) {
+		c = s.publicChanges(c)
+		if c.empty() {
+			return
+		}
+		// Lists without paths are sent as [], not null.
+		for _, l := range []*[]string{&c.Added, &c.Modified, &c.Removed} {
+			if *l == nil {
+				*l = []string{}
+			}
+		}
+		s.mu.RLock()
+		p := webhookPayload{Version: s.version, At: time.Now().UTC(), changeSet: c}
+		s.mu.RUnlock()
+		body, err := json.Marshal(p)
+		if err != nil {
+			errorf("webhook: %v", err)
+			return
+		}
+		for _, h := range hooks {
+			select {
+			case h.queue <- body:
+			default:
+				errorf("webhook: dropping the changes of version %d, %s is %d deliveries behind", p.Version, h.url, cap(h.queue))
+			}
+		}
+	}
+}
+
+// deliver posts body, retrying failures that may pass.
+func (h *webhook) deliver(body []byte) {
+	wait := time.Second
+	for attempt := 1; ; attempt++ {
+		retry, err := h.post(body)
+		if err == nil {
+			debugf("webhook: delivered to %s", h.url)
+			return
+		}
+		if !retry || attempt == webhookAttempts {
+			errorf("webhook: %v, giving up after %d attempts", err, attempt)
+			return
+		}
+		warnf("webhook: %v, retrying in %v", err, wait)
+		time.Sleep(wait)
+		wait *= 2
+	}
+}
+
+// post sends body once, reporting whether a failure is worth retrying, as
+// when the receiver is down or overloaded.
+func (h *webhook) post(body []byte) (retry bool, err error) {
+	req, err := http.NewRequest(http.MethodPost, h.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "fastserve-webhook")
+	if len(h.secret) > 0 {
+		mac := hmac.New(sha256.New, h.secret)
+		mac.Write(body)
+		req.Header.Set("X-Fastserve-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests, fmt.Errorf("POST %s: %s", h.url, resp.Status)
+	}
+	return false, nil
+}
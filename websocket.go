@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	wsGUID       = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+	wsPingPeriod = 30 * time.Second
+	wsPongWait   = 2 * wsPingPeriod
+
+	wsText  = 0x1
+	wsClose = 0x8
+	wsPing  = 0x9
+	wsPong  = 0xa
+)
+
+// wsMessage is a change event of /_/events, or the status with type stats.
+type wsMessage struct {
+	Type    string  `json:"type"`
+	Path    string  `json:"path,omitempty"`
+	Hash    string  `json:"hash,omitempty"`
+	Version int     `json:"version,omitempty"`
+	Stats   *status `json:"stats,omitempty"`
+}
+
+// allowedOrigin reports whether a browser page at the request's Origin may
+// open a WebSocket: one of -ws-origin, or the host itself if none are set.
+// Requests without an Origin don't come from browsers and are allowed.
+func (s *server) allowedOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if len(s.wsOrigins) == 0 {
+		u, err := url.Parse(origin)
+		return err == nil && strings.EqualFold(u.Host, r.Host)
+	}
+	for _, allowed := range s.wsOrigins {
+		if strings.EqualFold(origin, allowed) {
+			return true
+		}
+	}
+	return false
+}
+
+// handleWebSocket pushes the events of /_/events over a WebSocket, along with
+// the status every ping period, pinging the client to keep the connection
+// open and dropping it if it stops answering.
+func (s *server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") || key == "" {
+		http.Error(w, "websocket upgrade required", http.StatusUpgradeRequired)
+		return
+	}
+	if !s.allowedOrigin(r) {
+		http.Error(w, "origin not allowed", http.StatusForbidden)
+		return
+	}
+	conn, rw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Time{})
+
+	sum := sha1.Sum([]byte(key + wsGUID))
+	rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n")
+	rw.WriteString("Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(sum[:]) + "\r\n\r\n")
+	if err := rw.Flush(); err != nil {
+		return
+	}
+
+	ws := &wsConn{conn: conn, w: rw.Writer}
+	a := s.requestAccess(r)
+	ch := s.events.subscribe()
+	defer s.events.unsubscribe(ch)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if err := ws.readLoop(rw.Reader); err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+			errorf("websocket: %v", err)
+		}
+	}()
+
+	ticker := time.NewTicker(wsPingPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			st := s.status()
+			if ws.writeJSON(wsMessage{Type: "stats", Stats: &st}) != nil || ws.write(wsPing, nil) != nil {
+				return
+			}
+		case d, ok := <-ch:
+			if !ok {
+				ws.write(wsClose, nil)
+				return
+			}
+			s.mu.RLock()
+			d = s.visibleDiff(a, d)
+			s.mu.RUnlock()
+			for _, kind := range []struct {
+				name    string
+				changes []fileChange
+			}{{"added", d.Added}, {"modified", d.Modified}, {"removed", d.Removed}} {
+				for _, c := range kind.changes {
+					if ws.writeJSON(wsMessage{Type: kind.name, Path: c.Path, Hash: c.Hash, Version: d.Version}) != nil {
+						return
+					}
+				}
+			}
+		}
+	}
+}
+
+// wsConn writes WebSocket frames, from the pushing loop and the reading
+// one answering pings.
+type wsConn struct {
+	conn net.Conn
+	mu   sync.Mutex
+	w    *bufio.Writer
+}
+
+func (c *wsConn) writeJSON(v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return c.write(wsText, data)
+}
+
+// write sends an unmasked, unfragmented frame, as servers do.
+func (c *wsConn) write(opcode byte, payload []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(wsPingPeriod))
+	header := []byte{0x80 | opcode}
+	switch n := len(payload); {
+	case n < 126:
+		header = append(header, byte(n))
+	case n <= 0xffff:
+		header = binary.BigEndian.AppendUint16(append(header, 126), uint16(n))
+	default:
+		header = binary.BigEndian.AppendUint64(append(header, 127), uint64(n))
+	}
+	c.w.Write(header)
+	c.w.Write(payload)
+	return c.w.Flush()
+}
+
+// readLoop reads the client's frames, answering pings and closes, until the
+// client closes the connection or misses a pong for wsPongWait.
+func (c *wsConn) readLoop(r *bufio.Reader) error {
+	for {
+		c.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+		var head [2]byte
+		if _, err := io.ReadFull(r, head[:]); err != nil {
+			return err
+		}
+		opcode, masked, n := head[0]&0x0f, head[1]&0x80 != 0, uint64(head[1]&0x7f)
+		switch n {
+		case 126:
+			var ext [2]byte
+			if _, err := io.ReadFull(r, ext[:]); err != nil {
+				return err
+			}
+			n = uint64(binary.BigEndian.Uint16(ext[:]))
+		case 127:
+			var ext [8]byte
+			if _, err := io.ReadFull(r, ext[:]); err != nil {
+				return err
+			}
+			n = binary.BigEndian.Uint64(ext[:])
+		}
+		if !masked {
+			return errors.New("unmasked client frame")
+		}
+		if n > 1<<16 {
+			return errors.New("client frame too large")
+		}
+		var mask [4]byte
+		if _, err := io.ReadFull(r, mask[:]); err != nil {
+			return err
+		}
+		payload := make([]byte, n)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			return err
+		}
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+		switch opcode {
+		case wsPing:
+			if err := c.write(wsPong, payload); err != nil {
+				return err
+			}
+		case wsClose:
+			c.write(wsClose, payload)
+			return nil
+		}
+	}
+}